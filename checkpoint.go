@@ -0,0 +1,84 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "sync"
+  "time"
+)
+
+// Set in main when `checkpointfile` is configured, nil otherwise.
+var checkpoints *CheckpointFile
+var checkpointIntervalSeconds int64
+
+// Set in main when `offsetcheckpointpath` is configured, nil otherwise.  It holds the last
+// offset of each partition's last successful upload.
+var offsetCache *CheckpointFile
+
+type PartitionCheckpoint struct {
+  Topic        string    `json:"topic"`
+  Partition    int64     `json:"partition"`
+  Offset       uint64    `json:"offset"`
+  CheckpointAt time.Time `json:"checkpoint_at"`
+}
+
+// CheckpointFile records an offset for each partition: for checkpointfile, the last one written
+// to its buffer file and synced to disk, so recovery can resume past messages that are only in a
+// leftover buffer, and for offsetcheckpointpath, the last one uploaded, so recovery needn't
+// scan the destination for it.
+type CheckpointFile struct {
+  Path       string
+  lock       sync.Mutex
+  partitions map[string]*PartitionCheckpoint
+}
+
+// LoadCheckpointFile reads the checkpoints a previous run left in path, if any.
+func LoadCheckpointFile(path string) (*CheckpointFile, error) {
+  checkpointFile := &CheckpointFile{Path: path, partitions: make(map[string]*PartitionCheckpoint)}
+  checkpointBytes, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return checkpointFile, nil
+  } else if err != nil {
+    return nil, err
+  }
+  if err = json.Unmarshal(checkpointBytes, &checkpointFile.partitions); err != nil {
+    return nil, fmt.Errorf("couldn't parse checkpointfile %s: %s", path, err)
+  }
+  return checkpointFile, nil
+}
+
+func (checkpointFile *CheckpointFile) LastOffset(topic string, partition int64) (uint64, bool) {
+  checkpointFile.lock.Lock()
+  defer checkpointFile.lock.Unlock()
+  checkpoint, ok := checkpointFile.partitions[fmt.Sprintf("%s#%d", topic, partition)]
+  if !ok {
+    return 0, false
+  }
+  return checkpoint.Offset, true
+}
+
+// Checkpoint records a partition's offset and rewrites the file, to a temp file renamed into
+// place so a crash mid-write leaves the previous checkpoints intact.
+func (checkpointFile *CheckpointFile) Checkpoint(topic string, partition int64, offset uint64) error {
+  checkpointFile.lock.Lock()
+  defer checkpointFile.lock.Unlock()
+
+  name := fmt.Sprintf("%s#%d", topic, partition)
+  checkpointFile.partitions[name] = &PartitionCheckpoint{Topic: topic, Partition: partition, Offset: offset, CheckpointAt: time.Now()}
+
+  checkpointBytes, err := json.MarshalIndent(checkpointFile.partitions, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmpPath := checkpointFile.Path + ".tmp"
+  if err = ioutil.WriteFile(tmpPath, checkpointBytes, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, checkpointFile.Path)
+}
@@ -0,0 +1,143 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "fmt"
+  "strings"
+  "time"
+)
+
+const (
+  S3_COMPACTED_SUFFIX = "-compacted"
+  DEFAULT_COMPACT_SMALL_BYTES = 1024 * 1024
+  DEFAULT_COMPACT_MAX_BYTES = 128 * 1024 * 1024
+)
+
+// CompactDay rewrites each run of consecutive objects smaller than smallBytes under a
+// topic/partition's prefix for day into one object, of at most maxBytes before compression is
+// undone, then deletes the originals.  Only consecutive objects are merged, so the result's
+// offset range never overlaps a neighbor's.  It returns how many objects it replaced.
+func CompactDay(destination Destination, topic *string, partition int64, day time.Time, smallBytes int64, maxBytes int64) (int, error) {
+  prefix := S3TopicPartitionPrefix(topic, partition) + S3DatePrefix(&day)
+  replaced := 0
+  run := make([]DestinationKey, 0)
+  var runBytes int64 = 0
+  flushRun := func() error {
+    if len(run) > 1 {
+      if err := CompactObjects(destination, topic, partition, run); err != nil {
+        return err
+      }
+      replaced += len(run)
+    }
+    run = run[:0]
+    runBytes = 0
+    return nil
+  }
+
+  keyMarker := ""
+  for moreResults := true; moreResults; {
+    results, err := ListS3(destination, prefix, keyMarker)
+    if err != nil {
+      return replaced, err
+    }
+    if len(results.Contents) == 0 {
+      break
+    }
+    for _, key := range results.Contents {
+      if IsSidecarKey(key.Key) { continue }
+      if key.Size >= smallBytes || strings.HasSuffix(key.Key, S3_PARQUET_SUFFIX) || runBytes + key.Size > maxBytes {
+        if err = flushRun(); err != nil {
+          return replaced, err
+        }
+      }
+      if key.Size < smallBytes && !strings.HasSuffix(key.Key, S3_PARQUET_SUFFIX) {
+        run = append(run, key)
+        runBytes += key.Size
+      }
+    }
+    keyMarker = results.Contents[len(results.Contents)-1].Key
+    moreResults = results.IsTruncated
+  }
+  return replaced, flushRun()
+}
+
+// CompactObjects concatenates the records of objects, in key (and so offset) order, into an
+// uncompressed object named after the last of them, which sorts right after it, with a sidecar
+// of the combined offset range.  The originals are only deleted once it's written, so a crash
+// in between leaves the records twice rather than not at all.  Objects framed differently
+// can't share an object, so a run spanning a change of framing is left as it is.
+func CompactObjects(destination Destination, topic *string, partition int64, keys []DestinationKey) error {
+  contents := make([]byte, 0)
+  index := &BlockIndex{}
+  var runLayout RecordLayout
+  for k, key := range keys {
+    layout, err := ObjectRecordLayout(destination, key.Key)
+    if err != nil {
+      return err
+    }
+    if k == 0 {
+      runLayout = layout
+    } else if layout != runLayout {
+      return fmt.Errorf("%s is %s but %s is %s, leaving its run alone", key.Key, layout, keys[0].Key, runLayout)
+    }
+
+    first, last, found, err := S3ObjectOffsetRange(destination, key.Key, topic, partition)
+    if err != nil {
+      return err
+    }
+    if !found {
+      return fmt.Errorf("can't tell the offsets in %s, leaving its run alone", key.Key)
+    }
+    if k == 0 {
+      index.FirstKafkaOffset = first
+    }
+    index.LastKafkaOffset = last
+
+    objectBytes, err := destination.Get(key.Key)
+    if err != nil {
+      return err
+    }
+    if objectBytes, err = DecompressS3Object(key.Key, objectBytes); err != nil {
+      return err
+    }
+    records, complete := SplitRecords(runLayout.Framing, objectBytes)
+    index.Records += int64(len(records))
+    contents = append(contents, objectBytes[:complete]...)
+  }
+
+  lastKey := keys[len(keys)-1].Key
+  if codec, compressed := KeyCodec(lastKey); compressed {
+    lastKey = strings.TrimSuffix(lastKey, codec.Suffix())
+  }
+  compactedKey := strings.TrimSuffix(lastKey, S3_COMPACTED_SUFFIX) + S3_COMPACTED_SUFFIX
+  Log.Infof("Compacting %d objects (Offset:%d-%d) into %s", len(keys), index.FirstKafkaOffset, index.LastKafkaOffset, compactedKey)
+  meta := (&ChunkBuffer{Topic: topic, Partition: partition}).Meta()
+  delete(meta, META_RECORD_HEADER)
+  runLayout.AddTo(meta)
+  if err := PutWithRetry(destination, compactedKey, contents, "", meta); err != nil {
+    return err
+  }
+  if err := PutIndexSidecar(destination, compactedKey, index); err != nil {
+    return err
+  }
+  if writeManifests {
+    manifest := &Manifest{Topic: *topic, Partition: partition, FirstOffset: index.FirstKafkaOffset, LastOffset: index.LastKafkaOffset, MessageCount: index.Records, Bytes: int64(len(contents))}
+    if err := PutManifestSidecar(destination, compactedKey, manifest); err != nil {
+      return err
+    }
+  }
+
+  for _, key := range keys {
+    if key.Key == compactedKey { continue }
+    Log.Debugf("  Deleting %s", key.Key)
+    if err := destination.Delete(key.Key); err != nil {
+      return err
+    }
+    destination.Delete(key.Key + S3_INDEX_SUFFIX) // not every object has one, and deleting nothing succeeds
+    destination.Delete(key.Key + S3_MANIFEST_SUFFIX)
+  }
+  return nil
+}
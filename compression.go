@@ -0,0 +1,253 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "bytes"
+  "compress/gzip"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "strings"
+  "sync"
+
+  "github.com/golang/snappy"
+  "github.com/klauspost/compress/zstd"
+)
+
+const (
+  S3_GZIP_SUFFIX = ".gz"
+  S3_ZSTD_SUFFIX = ".zst"
+  S3_SNAPPY_SUFFIX = ".snappy"
+  S3_INDEX_SUFFIX = ".index"
+)
+
+// Encoders are pooled per codec and Reset onto each buffer file, a fresh zstd encoder alone
+// allocates megabytes of tables, and rotation makes a new stream for every buffer.
+var gzipWriterPool = sync.Pool{
+  New: func() interface{} { return gzip.NewWriter(nil) },
+}
+var zstdEncoderPool = sync.Pool{
+  New: func() interface{} {
+    encoder, _ := zstd.NewWriter(nil) // only fails on bad options
+    return encoder
+  },
+}
+var snappyWriterPool = sync.Pool{
+  New: func() interface{} { return snappy.NewBufferedWriter(nil) },
+}
+
+type streamEncoder interface {
+  io.WriteCloser
+  Flush() error
+  Reset(w io.Writer)
+}
+
+// pooledWriter hands its encoder back to the pool once Close has finished the stream.
+type pooledWriter struct {
+  encoder streamEncoder
+  pool    *sync.Pool
+}
+
+func newPooledWriter(pool *sync.Pool, w io.Writer) *pooledWriter {
+  encoder := pool.Get().(streamEncoder)
+  encoder.Reset(w)
+  return &pooledWriter{encoder: encoder, pool: pool}
+}
+
+func (writer *pooledWriter) Write(p []byte) (int, error) {
+  return writer.encoder.Write(p)
+}
+
+func (writer *pooledWriter) Flush() error {
+  return writer.encoder.Flush()
+}
+
+func (writer *pooledWriter) Close() error {
+  if writer.encoder == nil {
+    return nil
+  }
+  err := writer.encoder.Close()
+  writer.encoder.Reset(nil) // don't keep the buffer file alive from the pool
+  writer.pool.Put(writer.encoder)
+  writer.encoder = nil
+  return err
+}
+
+// BlockIndexEntry locates one independently compressed block inside an object, so
+// readers can issue a ranged GET starting at CompressedOffset and decompress from there.
+type BlockIndexEntry struct {
+  CompressedOffset   int64  `json:"compressed_offset"`
+  UncompressedOffset int64  `json:"uncompressed_offset"`
+  Records            int64  `json:"records"`
+  FirstKafkaOffset   uint64 `json:"first_kafka_offset"`
+}
+
+// BlockIndex is the `.index` sidecar of a compressed object.  Blocks is only filled in for
+// block compressed objects, the offsets let recovery skip decompressing the object at all.
+type BlockIndex struct {
+  Codec            string            `json:"codec"`
+  Records          int64             `json:"records"`
+  FirstKafkaOffset uint64            `json:"first_kafka_offset"`
+  LastKafkaOffset  uint64            `json:"last_kafka_offset"`
+  Blocks           []BlockIndexEntry `json:"blocks,omitempty"`
+}
+
+// BlockGzip compresses framed records into a series of gzip members of at most
+// recordsPerBlock records each, bgzip-style.  Plain gzip readers still see one stream,
+// but each member can also be decompressed on its own from its index entry.
+func BlockGzip(contents []byte, recordsPerBlock int64, parseOffset func(line string) (uint64, bool), out *bytes.Buffer) (*BlockIndex, error) {
+  index := &BlockIndex{Codec: "gzip"}
+  writer := gzipWriterPool.Get().(*gzip.Writer)
+  defer gzipWriterPool.Put(writer)
+
+  blockStart := 0
+  for blockStart < len(contents) {
+    blockEnd := blockStart
+    var records int64 = 0
+    for blockEnd < len(contents) && records < recordsPerBlock {
+      recordEnd, _ := recordFraming.RecordEnd(contents[blockEnd:])
+      blockEnd += recordEnd
+      records++
+    }
+
+    entry := BlockIndexEntry{
+      CompressedOffset: int64(out.Len()),
+      UncompressedOffset: int64(blockStart),
+      Records: records,
+    }
+    if firstRecordEnd, complete := recordFraming.RecordEnd(contents[blockStart:blockEnd]); complete && parseOffset != nil {
+      entry.FirstKafkaOffset, _ = parseOffset(string(recordFraming.Unframe(contents[blockStart:blockStart+firstRecordEnd])))
+    }
+    index.Blocks = append(index.Blocks, entry)
+
+    writer.Reset(out)
+    if _, err := writer.Write(contents[blockStart:blockEnd]); err != nil {
+      return nil, err
+    }
+    if err := writer.Close(); err != nil {
+      return nil, err
+    }
+    blockStart = blockEnd
+  }
+  return index, nil
+}
+
+// Codec is a way of compressing objects, named by `streamcompression`.  Everything that writes
+// or reads compressed buffers and objects goes through one, picked by name or by key suffix.
+type Codec interface {
+  Suffix() string
+  ContentType() string
+  NewWriter(w io.Writer) (io.WriteCloser, error)
+  NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]Codec{
+  "gzip": gzipCodec{},
+  "zstd": zstdCodec{},
+  "snappy": snappyCodec{},
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Suffix() string { return S3_GZIP_SUFFIX }
+func (gzipCodec) ContentType() string { return "application/x-gzip" }
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return newPooledWriter(&gzipWriterPool, w), nil }
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+
+type zstdCodec struct{}
+
+func (zstdCodec) Suffix() string { return S3_ZSTD_SUFFIX }
+func (zstdCodec) ContentType() string { return "application/zstd" }
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return newPooledWriter(&zstdEncoderPool, w), nil }
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+  decoder, err := zstd.NewReader(r)
+  if err != nil {
+    return nil, err
+  }
+  return decoder.IOReadCloser(), nil
+}
+
+// snappyCodec writes the snappy framing format, which is what Hadoop and Spark read as .snappy
+// streams, rather than a single raw snappy block.
+type snappyCodec struct{}
+
+func (snappyCodec) Suffix() string { return S3_SNAPPY_SUFFIX }
+func (snappyCodec) ContentType() string { return "application/x-snappy-framed" }
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return newPooledWriter(&snappyWriterPool, w), nil }
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(snappy.NewReader(r)), nil }
+
+func CodecSuffix(codec string) string {
+  if c, ok := codecs[codec]; ok {
+    return c.Suffix()
+  }
+  return ""
+}
+
+func CodecContentType(codec string) string {
+  if c, ok := codecs[codec]; ok {
+    return c.ContentType()
+  }
+  return ""
+}
+
+// NewStreamCompressor wraps a buffer file so records are compressed as they're written,
+// rather than all at once at flush time.
+func NewStreamCompressor(codec string, w io.Writer) (io.WriteCloser, error) {
+  if c, ok := codecs[codec]; ok {
+    return c.NewWriter(w)
+  }
+  return nil, fmt.Errorf("unknown compression codec `%s`", codec)
+}
+
+// KeyCodec is the codec an object was written with, going by its key's suffix.
+func KeyCodec(key string) (Codec, bool) {
+  for _, c := range codecs {
+    if strings.HasSuffix(key, c.Suffix()) {
+      return c, true
+    }
+  }
+  return nil, false
+}
+
+func IsCompressedKey(key string) bool {
+  _, compressed := KeyCodec(key)
+  return compressed
+}
+
+// DecompressS3Object undoes whatever compression the key's suffix says the object was written with.
+func DecompressS3Object(key string, contents []byte) ([]byte, error) {
+  codec, compressed := KeyCodec(key)
+  if !compressed {
+    return contents, nil
+  }
+  reader, err := codec.NewReader(bytes.NewReader(contents))
+  if err != nil {
+    return nil, err
+  }
+  defer reader.Close()
+  return ioutil.ReadAll(reader)
+}
+
+// DecompressTruncated decompresses as much of a stream as is there, for buffer files whose
+// compressor was never closed, e.g. when the consumer crashed.
+func DecompressTruncated(codec string, contents []byte) ([]byte, error) {
+  c, ok := codecs[codec]
+  if !ok {
+    return nil, fmt.Errorf("unknown compression codec `%s`", codec)
+  }
+  reader, err := c.NewReader(bytes.NewReader(contents))
+  if err != nil {
+    return nil, err
+  }
+  defer reader.Close()
+  decompressed, _ := ioutil.ReadAll(reader) // the unexpected EOF is expected
+  return decompressed, nil
+}
+
+// Sidecar objects sit next to the data objects but never hold messages.
+func IsSidecarKey(key string) bool {
+  return strings.HasSuffix(key, S3_INDEX_SUFFIX) || strings.HasSuffix(key, S3_MANIFEST_SUFFIX)
+}
@@ -0,0 +1,79 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "sync"
+  "testing"
+)
+
+func streamCompressionPayload() []byte {
+  payload := new(bytes.Buffer)
+  for i := 0; i < 1000; i++ {
+    fmt.Fprintf(payload, "t_clicks-p_0-o_%d|{\"user\":%d,\"path\":\"/items/%d\"}\n", i * 64, i % 97, i)
+  }
+  return payload.Bytes()
+}
+
+func TestStreamCompressorRoundTrip(t *testing.T) {
+  payload := streamCompressionPayload()
+  for name, _ := range codecs {
+    for round := 0; round < 3; round++ { // later rounds get a pooled encoder
+      compressed := new(bytes.Buffer)
+      compressor, err := NewStreamCompressor(name, compressed)
+      if err != nil {
+        t.Fatalf("%s: %s", name, err)
+      }
+      compressor.Write(payload)
+      if err = compressor.Close(); err != nil {
+        t.Fatalf("%s: %s", name, err)
+      }
+      decompressed, err := DecompressS3Object("key" + CodecSuffix(name), compressed.Bytes())
+      if err != nil {
+        t.Fatalf("%s round %d: %s", name, round, err)
+      }
+      if !bytes.Equal(decompressed, payload) {
+        t.Fatalf("%s round %d: decompressed %d bytes, want the %d written", name, round, len(decompressed), len(payload))
+      }
+    }
+  }
+}
+
+// Compare with BenchmarkStreamCompressorUnpooled for what pooling the encoders saves per buffer.
+func BenchmarkStreamCompressor(b *testing.B) {
+  payload := streamCompressionPayload()
+  for _, name := range []string{"gzip", "zstd", "snappy"} {
+    b.Run(name, func(b *testing.B) {
+      compressed := new(bytes.Buffer)
+      b.ReportAllocs()
+      for n := 0; n < b.N; n++ {
+        compressed.Reset()
+        compressor, _ := NewStreamCompressor(name, compressed)
+        compressor.Write(payload)
+        compressor.Close()
+      }
+    })
+  }
+}
+
+func BenchmarkStreamCompressorUnpooled(b *testing.B) {
+  payload := streamCompressionPayload()
+  for _, name := range []string{"gzip", "zstd", "snappy"} {
+    pool := map[string]*sync.Pool{"gzip": &gzipWriterPool, "zstd": &zstdEncoderPool, "snappy": &snappyWriterPool}[name]
+    b.Run(name, func(b *testing.B) {
+      compressed := new(bytes.Buffer)
+      b.ReportAllocs()
+      for n := 0; n < b.N; n++ {
+        compressed.Reset()
+        encoder := pool.New().(streamEncoder)
+        encoder.Reset(compressed)
+        encoder.Write(payload)
+        encoder.Close()
+      }
+    })
+  }
+}
@@ -0,0 +1,165 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+
+  "github.com/crowdmob/goamz/aws"
+  configfile "github.com/crowdmob/goconfig"
+)
+
+// Options main reads with their errors ignored, so a missing or mistyped one would otherwise
+// quietly be "", 0 or false.
+var requiredConfigOptions = [][2]string{
+  {"kafka", "host"},
+  {"kafka", "port"},
+  {"kafka", "topics"},
+  {"default", "filebufferpath"},
+}
+
+var positiveConfigOptions = [][2]string{
+  {"default", "maxchunksizebytes"},
+  {"default", "maxchunkagemins"},
+}
+
+var numericConfigOptions = map[string][]string{
+  "default": {"blockcompressionrecords", "checkpointintervalseconds", "compressminbytes", "drainshutdowntimeoutseconds",
+    "flushboundaryseconds", "flushintervalseconds", "healthmaxstaleseconds", "healthstaleflushseconds", "inprogressseconds", "maxbufferlatencyseconds",
+    "maxchunkhardagemins", "minchunksizebytes", "minmessagesperobject", "parquetrowgroupbytes", "pollsleepmillis", "recoveryprefetch", "recoveryscanobjects",
+    "recoverytailbytes", "retryintervalseconds", "statsintervalseconds", "uploadworkers"},
+  "kafka": {"maxmessagesize", "maxmessagespartition", "maxmessagespersec", "selftestpartition"},
+  "s3": {"compactmaxbytes", "compactsmallbytes", "incompleteuploadagehours", "maxclockskewseconds", "partitionwidth",
+    "retrymaxbackoffmillis", "s3maxlistconcurrency", "s3requesttimeoutseconds"},
+  "schemaregistry": {"schemaid"},
+}
+
+var booleanConfigOptions = map[string][]string{
+  "default": {"compress", "coordinatedflush", "debug", "drainonshutdown", "healthdegradedok", "healthfailwhendegraded",
+    "ingesttimestamps",
+    "writemanifest"},
+  "s3": {"cleanupincompleteuploads", "clusterinkey", "confirmuploads", "deterministickeys", "keyhostname", "pathstyle",
+    "retryjitter", "topicsanitize", "useiamrole"},
+  "schemaregistry": {"validate"},
+}
+
+// ValidateConfig checks the config file before main reads anything from it: that the options
+// it can't run without are there, that sizes and ages are positive, that numbers and booleans
+// parse, and that an S3 destination has a bucket and a region it knows.  The error names the
+// option to fix.
+func ValidateConfig(config *configfile.ConfigFile) error {
+  for _, option := range requiredConfigOptions {
+    if value, _ := config.GetString(option[0], option[1]); len(strings.TrimSpace(value)) == 0 {
+      return fmt.Errorf("%s is missing from the [%s] section", option[1], option[0])
+    }
+  }
+  if port, _ := config.GetString("kafka", "port"); !validPort(port) {
+    return fmt.Errorf("port `%s` in the [kafka] section isn't a port number", port)
+  }
+
+  sections := []string{}
+  for section, _ := range numericConfigOptions {
+    sections = append(sections, section)
+  }
+  sort.Strings(sections)
+  for _, section := range sections {
+    for _, option := range numericConfigOptions[section] {
+      if !config.HasOption(section, option) { continue }
+      if _, err := config.GetInt64(section, option); err != nil {
+        value, _ := config.GetString(section, option)
+        return fmt.Errorf("%s `%s` in the [%s] section isn't a whole number", option, value, section)
+      }
+    }
+  }
+  sections = sections[:0]
+  for section, _ := range booleanConfigOptions {
+    sections = append(sections, section)
+  }
+  sort.Strings(sections)
+  for _, section := range sections {
+    for _, option := range booleanConfigOptions[section] {
+      if !config.HasOption(section, option) { continue }
+      if _, err := config.GetBool(section, option); err != nil {
+        value, _ := config.GetString(section, option)
+        return fmt.Errorf("%s `%s` in the [%s] section isn't true or false", option, value, section)
+      }
+    }
+  }
+
+  // a topic's own section can override the sizes, so they have to be positive there too
+  positiveOptions := append([][2]string{}, positiveConfigOptions...)
+  for _, section := range config.GetSections() {
+    if !strings.HasPrefix(section, "topic:") { continue }
+    for _, option := range positiveConfigOptions {
+      if config.HasOption(section, option[1]) {
+        positiveOptions = append(positiveOptions, [2]string{section, option[1]})
+      }
+    }
+  }
+  for _, option := range positiveOptions {
+    value, _ := config.GetString(option[0], option[1])
+    if number, err := config.GetInt64(option[0], option[1]); err != nil || number <= 0 {
+      return fmt.Errorf("%s `%s` in the [%s] section must be a whole number above 0", option[1], value, option[0])
+    }
+  }
+
+  if destinationType, _ := config.GetString("default", "destination"); destinationType == "" || destinationType == DESTINATION_S3 {
+    if bucket, _ := config.GetString("s3", "bucket"); len(strings.TrimSpace(bucket)) == 0 {
+      return fmt.Errorf("bucket is missing from the [s3] section")
+    }
+    // an endpoint's region is only used for signing, and defaults to us-east-1
+    if endpoint, _ := config.GetString("s3", "endpoint"); len(endpoint) == 0 {
+      region, _ := config.GetString("s3", "region")
+      if _, ok := aws.Regions[region]; !ok {
+        validRegions := make([]string, 0, len(aws.Regions))
+        for name := range aws.Regions {
+          validRegions = append(validRegions, name)
+        }
+        sort.Strings(validRegions)
+        return fmt.Errorf("region `%s` in the [s3] section must be one of %s", region, strings.Join(validRegions, ", "))
+      }
+    }
+  }
+  return nil
+}
+
+// ConfigOptionName is whichever of option and the deprecated names it replaced is set in
+// section, option when none is, with a warning when it's a deprecated one.
+func ConfigOptionName(config *configfile.ConfigFile, section string, option string, deprecated ...string) string {
+  if config.HasOption(section, option) {
+    return option
+  }
+  for _, name := range deprecated {
+    if config.HasOption(section, name) {
+      Log.Warnf("%s in the [%s] section is deprecated, set %s instead", name, section, option)
+      return name
+    }
+  }
+  return option
+}
+
+// ConfiguredResetPolicy reads option of the [kafka] section as an offset reset policy,
+// earliest, latest or fail, which it is when unset.
+func ConfiguredResetPolicy(config *configfile.ConfigFile, option string) string {
+  policy, _ := config.GetString("kafka", option)
+  switch policy {
+  case "":
+    return "fail"
+  case "earliest", "latest", "fail":
+    return policy
+  }
+  Log.Errorf("Invalid %s `%s` in config file %s, must be one of earliest, latest or fail", option, policy, configFilename)
+  os.Exit(1)
+  return ""
+}
+
+func validPort(port string) bool {
+  number, err := strconv.Atoi(strings.TrimSpace(port))
+  return err == nil && number > 0 && number < 65536
+}
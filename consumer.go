@@ -5,66 +5,210 @@ Author: Matthew Moore, CrowdMob Inc.
 package main
 
 import (
+  "bytes"
+  "context"
+  "crypto/md5"
+  "encoding/binary"
+  "encoding/hex"
+  "encoding/json"
   "flag"
   "fmt"
+  "hash/crc32"
   "github.com/crowdmob/kafka"
   "os"
   "os/signal"
+  "io"
   "io/ioutil"
   "strings"
   "strconv"
+  "syscall"
+  "sync"
+  "sync/atomic"
   "time"
+  "math/rand"
   "mime"
+  "net/http"
+  "net/url"
   "path/filepath"
+  "regexp"
   
   configfile "github.com/crowdmob/goconfig"
   "github.com/crowdmob/goamz/aws"
   "github.com/crowdmob/goamz/s3"
+  "github.com/crowdmob/goamz/sns"
 )
 
 var configFilename string
 var keepBufferFiles bool
-var debug bool
+var debug bool // loglevel=DEBUG, for the little output that isn't a log line
 var shouldOutputVersion bool
+var verifyContinuity string
+var selfTest bool
+var dryRun bool
+var compactPartition string
+var compactDay string
+var partitionPadWidth int
+var blockCompressionRecords int64
+var confirmUploads bool
+var topicPrefixes = make(map[string]string)
+var recordChecksum bool
+var ingestTimestamps bool
+var now = time.Now // the clock ingest timestamps are read from, tests set their own
+var keyHostname string
+var inProgressSeconds int64
+var s3ListSlots chan bool
+var dateFormat = S3_DEFAULT_DATE_FORMAT
+var partitionBy = PARTITION_BY_UPLOAD_TIME
+var pathGranularity = PATH_GRANULARITY_DAY
+var s3RetryMaxBackoff time.Duration
+var s3RetryJitter bool
+var recoveryTailBytes int64
+var deterministicKeys bool
+var onKeyExists string
+var compressMinBytes int64
+var compactRecordHeader bool
+var kafkaClusterName string
+var environment string
+var clusterInKey bool
+var topicSanitizeReplacement *string // nil unless topicsanitize is on
+var topicUnsafeChars = regexp.MustCompile(`[^a-z0-9_-]`)
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 const (
   VERSION = "0.1"
   ONE_MINUTE_IN_NANOS = 60000000000
+  FLUSH_TICK_INTERVAL = 1 * time.Second
+  DRAIN_IDLE_POLLS = 5
+  UPLOAD_QUEUE_DEPTH = 4 // rotated buffers a partition can have waiting for upload before rotating blocks
+  DEFAULT_CHECKPOINT_INTERVAL_SECONDS = 10
+  UNIX_NANO_DIGITS = 19 // in every UnixNano from 2001 to 2286
+  DEFAULT_HARD_AGE_MULTIPLE = 4 // of maxchunkagemins, when minchunksizebytes is set without maxchunkhardagemins
+  RECORD_HEADER_TEXT = "text"
+  RECORD_HEADER_COMPACT = "compact"
+  COMPACT_HEADER_MARKER = 0x00 // never the first byte of a text guid
   S3_REWIND_IN_DAYS_BEFORE_LONG_LOOP = 14
+  S3_RECOVERY_MAX_SCAN_OBJECTS = 256 // before giving up on finding an offset, when recoveryscanobjects didn't
   DAY_IN_SECONDS = 24 * 60 * 60
+  S3_DEAD_LETTER_PREFIX = "deadletter/"
+  S3_IN_PROGRESS_PREFIX = "inprogress/"
+  S3_DEFAULT_DATE_FORMAT = "2006/01/02/"
+  PARTITION_BY_UPLOAD_TIME = "uploadtime"
+  PARTITION_BY_MESSAGE_TIME = "messagetime"
+  PATH_GRANULARITY_DAY = "day"
+  PATH_GRANULARITY_HOUR = "hour"
+  ON_KEY_EXISTS_RENAME = "rename"
+  ON_KEY_EXISTS_OVERWRITE = "overwrite"
+  ON_KEY_EXISTS_SKIP = "skip"
+  ON_KEY_EXISTS_FAIL = "fail"
+  S3_PUT_ATTEMPTS = 3
+  S3_PUT_INITIAL_BACKOFF = 1 * time.Second
+  KAFKA_OFFSET_LATEST = -1
+  KAFKA_OFFSET_EARLIEST = -2
+  KAFKA_ERROR_OFFSET_OUT_OF_RANGE = 1
 )
 
 func init() {
   flag.StringVar(&configFilename, "c", "conf.properties", "path to config file")
 	flag.BoolVar(&keepBufferFiles, "k", false, "keep buffer files around for inspection")
 	flag.BoolVar(&shouldOutputVersion, "v", false, "output the current version and quit")
+	flag.StringVar(&verifyContinuity, "verify-continuity", "", "check the archived objects of a topic#partition for overlapping offsets and quit")
+	flag.BoolVar(&selfTest, "selftest", false, "read from the selftest topic, round trip it through S3 and quit")
+	flag.BoolVar(&dryRun, "dry-run", false, "consume and log what would be uploaded, without writing to or deleting from the destination")
+	flag.StringVar(&compactPartition, "compact", "", "merge the small objects a topic#partition archived on -compact-day and quit")
+	flag.StringVar(&compactDay, "compact-day", "", "day to compact, as YYYY-MM-DD (default yesterday)")
 }
 
 
 type ChunkBuffer struct {
-  File            *os.File
-  FilePath        *string
-  MaxAgeInMins    int64
-  MaxSizeInBytes  int64
-  Topic           *string
-  Partition       int64
-  Offset          uint64
-  expiresAt       int64
-  length          int64
+  File              *os.File
+  FilePath          *string
+  MaxAgeInMins      int64
+  MaxHardAgeInMins  int64
+  MaxSizeInBytes    int64
+  MinSizeInBytes    int64
+  MaxLatencyInSecs  int64
+  MinMessages       int64
+  Topic             *string
+  Partition         int64
+  Offset            uint64
+  expiresAt         int64
+  hardExpiresAt     int64
+  length            int64
+  firstOffset       uint64
+  messageCount      int64
+  oldestMessageAt   int64
+  newestMessageAt   int64
+  DeadLetter        bool
+  Compression       string
+  Format            string
+  writer            io.Writer
+  compressor        io.WriteCloser
+  inProgressAt      int64
+  inProgressLength  int64
+  checkpointAt      int64
+  checkpointOffset  uint64
 }
 
 func (chunkBuffer *ChunkBuffer) BaseFilename() string {
+  if chunkBuffer.DeadLetter {
+    return fmt.Sprintf("kafka-s3-go-consumer-deadletter-topic_%s-partition_%d-offset_%d-", *chunkBuffer.Topic, chunkBuffer.Partition, chunkBuffer.Offset)
+  }
   return fmt.Sprintf("kafka-s3-go-consumer-buffer-topic_%s-partition_%d-offset_%d-", *chunkBuffer.Topic, chunkBuffer.Partition, chunkBuffer.Offset)
 }
 
+// Dead letters live under their own root, so offset recovery never lists them.
+func (chunkBuffer *ChunkBuffer) KeyPrefix() string {
+  if chunkBuffer.DeadLetter {
+    return S3_DEAD_LETTER_PREFIX
+  }
+  return ""
+}
+
+func (chunkBuffer *ChunkBuffer) Log() *Logger {
+  return PartitionLogger(*chunkBuffer.Topic, chunkBuffer.Partition)
+}
+
+// Successor is an empty buffer with the same settings, picking up at this buffer's offset.
+// The caller still has to CreateBufferFileOrPanic.
+func (chunkBuffer *ChunkBuffer) Successor() *ChunkBuffer {
+  return &ChunkBuffer{FilePath: chunkBuffer.FilePath,
+    MaxSizeInBytes: chunkBuffer.MaxSizeInBytes,
+    MaxAgeInMins: chunkBuffer.MaxAgeInMins,
+    MaxHardAgeInMins: chunkBuffer.MaxHardAgeInMins,
+    MinSizeInBytes: chunkBuffer.MinSizeInBytes,
+    MaxLatencyInSecs: chunkBuffer.MaxLatencyInSecs,
+    MinMessages: chunkBuffer.MinMessages,
+    Topic: chunkBuffer.Topic,
+    Partition: chunkBuffer.Partition,
+    Offset: chunkBuffer.Offset,
+    DeadLetter: chunkBuffer.DeadLetter,
+    Compression: chunkBuffer.Compression,
+    Format: chunkBuffer.Format,
+  }
+}
+
 func (chunkBuffer *ChunkBuffer) CreateBufferFileOrPanic() {
   tmpfile, err := ioutil.TempFile(*chunkBuffer.FilePath, chunkBuffer.BaseFilename())
   chunkBuffer.File = tmpfile
-  chunkBuffer.expiresAt = time.Now().UnixNano() + (chunkBuffer.MaxAgeInMins * ONE_MINUTE_IN_NANOS)
+  chunkBuffer.writer = tmpfile
+  chunkBuffer.restartClock()
   chunkBuffer.length = 0
   if err != nil {
-    fmt.Errorf("Error opening buffer file: %#v\n", err)
+    chunkBuffer.Log().Errorf("Error opening buffer file: %#v", err)
     panic(err)
   }
+  if len(chunkBuffer.Compression) > 0 {
+    chunkBuffer.compressor, err = NewStreamCompressor(chunkBuffer.Compression, tmpfile)
+    if err != nil {
+      panic(err)
+    }
+    chunkBuffer.writer = chunkBuffer.compressor
+  }
+}
+
+// restartClock starts the buffer's max and hard ages over.
+func (chunkBuffer *ChunkBuffer) restartClock() {
+  chunkBuffer.expiresAt = time.Now().UnixNano() + (chunkBuffer.MaxAgeInMins * ONE_MINUTE_IN_NANOS)
+  chunkBuffer.hardExpiresAt = time.Now().UnixNano() + (chunkBuffer.HardAgeInMins() * ONE_MINUTE_IN_NANOS)
 }
 
 func (chunkBuffer *ChunkBuffer) TooBig() bool {
@@ -75,242 +219,1876 @@ func (chunkBuffer *ChunkBuffer) TooOld() bool {
   return time.Now().UnixNano() >= chunkBuffer.expiresAt
 }
 
+// TooLatent is the hard latency guarantee: the oldest unflushed message has waited longer
+// than MaxLatencyInSecs, no matter what the size/age rotation policy says.
+func (chunkBuffer *ChunkBuffer) TooLatent() bool {
+  if chunkBuffer.MaxLatencyInSecs <= 0 || chunkBuffer.messageCount == 0 {
+    return false
+  }
+  return time.Now().UnixNano() >= chunkBuffer.oldestMessageAt + chunkBuffer.MaxLatencyInSecs * int64(time.Second)
+}
+
+// HardAgeInMins is how old a buffer short of MinSizeInBytes gets before it rotates anyway,
+// never less than MaxAgeInMins.
+func (chunkBuffer *ChunkBuffer) HardAgeInMins() int64 {
+  if chunkBuffer.MinSizeInBytes <= 0 {
+    return chunkBuffer.MaxAgeInMins
+  }
+  if chunkBuffer.MaxHardAgeInMins <= 0 {
+    return chunkBuffer.MaxAgeInMins * DEFAULT_HARD_AGE_MULTIPLE
+  }
+  if chunkBuffer.MaxHardAgeInMins < chunkBuffer.MaxAgeInMins {
+    return chunkBuffer.MaxAgeInMins
+  }
+  return chunkBuffer.MaxHardAgeInMins
+}
+
+// AgedOut is TooOld for buffers of at least MinSizeInBytes, the rest get until the hard age,
+// so quiet partitions write fewer, bigger objects but still write them.
+func (chunkBuffer *ChunkBuffer) AgedOut() bool {
+  if chunkBuffer.length < chunkBuffer.MinSizeInBytes {
+    return time.Now().UnixNano() >= chunkBuffer.hardExpiresAt
+  }
+  return chunkBuffer.TooOld()
+}
+
+// Buffers short of MinMessages only rotate once they're AgedOut, the hard age stays a ceiling.
 func (chunkBuffer *ChunkBuffer) NeedsRotation() bool {
-  return chunkBuffer.TooBig() || chunkBuffer.TooOld()
+  if chunkBuffer.messageCount < chunkBuffer.MinMessages {
+    return chunkBuffer.AgedOut()
+  }
+  return chunkBuffer.TooBig() || chunkBuffer.AgedOut() || chunkBuffer.TooLatent()
 }
 
+// S3DatePrefix formats with `dateformat`, a Go reference time layout, which defaults to a zero
+// padded year/month/day/ so keys sort in date order.  Dates are always in UTC, so hosts in
+// different time zones agree on them.
 func S3DatePrefix(t *time.Time) string {
-  return fmt.Sprintf("%d/%d/%d/", t.Year(), t.Month(), t.Day())
+  return t.UTC().Format(dateFormat)
 }
 
+// S3TimePrefix is the date prefix keys are written under, followed by the zero padded UTC
+// hour, HH/, with pathgranularity=hour.  Listing a day's prefix still finds all of its hours.
+func S3TimePrefix(t *time.Time) string {
+  if pathGranularity == PATH_GRANULARITY_HOUR {
+    return S3DatePrefix(t) + t.UTC().Format("15/")
+  }
+  return S3DatePrefix(t)
+}
+
+// KeyTime is the time whose date a buffer's key goes under: now, or with partitionby=messagetime
+// when its first message was read, so a buffer that spans midnight or flushes late still
+// lands under the day its messages arrived.  Kafka 0.7 messages don't carry a timestamp of
+// their own, so reading them is as close as it gets.  Buffers that don't know when that was
+// (leftovers from a previous run) go under now.
+func (chunkBuffer *ChunkBuffer) KeyTime() time.Time {
+  if partitionBy == PARTITION_BY_MESSAGE_TIME && chunkBuffer.oldestMessageAt > 0 {
+    return time.Unix(0, chunkBuffer.oldestMessageAt)
+  }
+  return time.Now()
+}
+
+// Used by both the upload and the offset recovery listing, so keys and lookups always agree.
 func S3TopicPartitionPrefix(topic *string, partition int64) string {
-  return fmt.Sprintf("%s/p%d/", *topic, partition)
+  return fmt.Sprintf("%sp%0*d/", S3TopicPrefix(topic), partitionPadWidth, partition)
+}
+
+func S3TopicPrefix(topic *string) string {
+  prefix := ""
+  if len(environment) > 0 {
+    prefix = environment + "/"
+  }
+  if clusterInKey {
+    prefix += kafkaClusterName + "/"
+  }
+  return prefix + S3TopicName(topic) + "/"
+}
+
+// S3TopicName is the topic's part of its keys, from topicprefixes if it's listed there, else
+// the topic itself, lowercased with anything but letters, digits, - and _ replaced when
+// `topicsanitize` is on.
+func S3TopicName(topic *string) string {
+  if renamed, ok := topicPrefixes[*topic]; ok {
+    return renamed
+  }
+  if topicSanitizeReplacement != nil {
+    return topicUnsafeChars.ReplaceAllLiteralString(strings.ToLower(*topic), *topicSanitizeReplacement)
+  }
+  return *topic
 }
 
 func KafkaMsgGuidPrefix(topic *string, partition int64) string {
   return fmt.Sprintf("t_%s-p_%d-o_", *topic, partition)
 }
 
-func (chunkBuffer *ChunkBuffer) PutMessage(msg *kafka.Message) {
-  uuid := []byte(fmt.Sprintf("%s%d|", KafkaMsgGuidPrefix(chunkBuffer.Topic, chunkBuffer.Partition), msg.Offset()))
-  lf := []byte("\n")
+// ParseGuidOffset extracts the offset from a line written by PutMessage, ok is false when
+// the line doesn't start with a well formed guid.  Anything after the guid, a checksum
+// field included, is ignored.
+func ParseGuidOffset(line string, guidPrefix string) (uint64, bool) {
+  if !strings.HasPrefix(line, guidPrefix) || !strings.Contains(line, "|") {
+    return 0, false
+  }
+  offset, err := strconv.ParseUint(strings.SplitN(line[len(guidPrefix):], "|", 2)[0], 10, 64)
+  return offset, err == nil
+}
+
+// KafkaMessage is what a buffer needs of a *kafka.Message, whose offset only a broker can set.
+type KafkaMessage interface {
+  Offset() uint64
+  Payload() []byte
+}
+
+func (chunkBuffer *ChunkBuffer) PutMessage(msg KafkaMessage) {
+  chunkBuffer.putRecord(msg.Offset(), msg.Payload())
+}
+
+// PutDeadLetter writes a rejected message with the reason it was rejected between its
+// guid and payload, for buffers that upload under the dead letter prefix.
+func (chunkBuffer *ChunkBuffer) PutDeadLetter(msg KafkaMessage, reason string) {
+  reasonField := []byte(strings.Replace(strings.Replace(reason, "|", "/", -1), "\n", " ", -1) + "|")
+  chunkBuffer.putRecord(msg.Offset(), reasonField, msg.Payload())
+}
+
+// RecordHeader is the guid that starts every line, followed by a CRC32C of the rest of the
+// line (without the newline) as 8 hex digits when `recordchecksum` is crc32c, then the
+// unix time in milliseconds the record was ingested when `ingesttimestamps` is on.
+func RecordHeader(topic *string, partition int64, offset uint64, fields ...[]byte) []byte {
+  if compactRecordHeader {
+    return CompactRecordHeader(offset, fields...)
+  }
+  header := fmt.Sprintf("%s%d|", KafkaMsgGuidPrefix(topic, partition), offset)
+  var ingestField []byte
+  if ingestTimestamps {
+    ingestField = []byte(fmt.Sprintf("%d|", now().UnixNano() / int64(time.Millisecond)))
+  }
+  if recordChecksum {
+    header = fmt.Sprintf("%s%08x|", header, RecordChecksum(ingestField, fields...))
+  }
+  return append([]byte(header), ingestField...)
+}
+
+// CompactRecordHeader is the binary header `recordheader=compact` writes instead: a marker
+// byte and the offset as a uvarint, then the CRC32C as 4 big endian bytes and the ingest time
+// as a uvarint when they're on.  Topic and partition are left to the object's key.
+func CompactRecordHeader(offset uint64, fields ...[]byte) []byte {
+  header := []byte{COMPACT_HEADER_MARKER}
+  header = append(header, uvarint(offset)...)
+  var ingestField []byte
+  if ingestTimestamps {
+    ingestField = uvarint(uint64(now().UnixNano() / int64(time.Millisecond)))
+  }
+  if recordChecksum {
+    checksum := make([]byte, 4)
+    binary.BigEndian.PutUint32(checksum, RecordChecksum(ingestField, fields...))
+    header = append(header, checksum...)
+  }
+  return append(header, ingestField...)
+}
+
+// ParseCompactOffset is ParseGuidOffset for records with a compact header.
+func ParseCompactOffset(line string) (uint64, bool) {
+  if len(line) == 0 || line[0] != COMPACT_HEADER_MARKER {
+    return 0, false
+  }
+  offset, n := binary.Uvarint([]byte(line[1:]))
+  return offset, n > 0
+}
+
+func RecordChecksum(ingestField []byte, fields ...[]byte) uint32 {
+  checksum := crc32.Checksum(ingestField, crc32cTable)
+  for _, field := range fields {
+    checksum = crc32.Update(checksum, crc32cTable, field)
+  }
+  return checksum
+}
+
+func uvarint(value uint64) []byte {
+  encoded := make([]byte, binary.MaxVarintLen64)
+  return encoded[:binary.PutUvarint(encoded, value)]
+}
+
+func (chunkBuffer *ChunkBuffer) putRecord(offset uint64, fields ...[]byte) {
+  pieces := recordFraming.Frame(EncodeRecord(chunkBuffer.Format, chunkBuffer.Topic, chunkBuffer.Partition, offset, fields...))
+  if chunkBuffer.messageCount == 0 {
+    chunkBuffer.firstOffset = offset
+    chunkBuffer.oldestMessageAt = time.Now().UnixNano()
+  }
+  chunkBuffer.newestMessageAt = time.Now().UnixNano()
+  chunkBuffer.messageCount++
+  chunkBuffer.Offset = offset
+  for _, piece := range pieces {
+    chunkBuffer.writer.Write(piece)
+    chunkBuffer.length += int64(len(piece))
+  }
+}
+
+
+var flushBufferPool = sync.Pool{
+  New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func (chunkBuffer *ChunkBuffer) closeBufferFile() {
+  chunkBuffer.Log().Debugf("Closing bufferfile: %s", chunkBuffer.File.Name())
+  if chunkBuffer.compressor != nil {
+    if err := chunkBuffer.compressor.Close(); err != nil { // its last frame is written now
+      chunkBuffer.Log().Errorf("Error finishing compression of bufferfile %s: %s", chunkBuffer.File.Name(), err)
+    }
+  }
+  if err := chunkBuffer.File.Close(); err != nil {
+    chunkBuffer.Log().Warnf("Error closing bufferfile %s: %s", chunkBuffer.File.Name(), err)
+  }
+}
+
+// Meta is the metadata every object written from the buffer is tagged with, x-amz-meta-* on S3.
+func (chunkBuffer *ChunkBuffer) Meta() map[string][]string {
+  meta := make(map[string][]string)
+  if version := TopicSchemaVersion(*chunkBuffer.Topic); len(version) > 0 && !chunkBuffer.DeadLetter {
+    meta["schema-version"] = []string{version}
+  }
+  if len(kafkaClusterName) > 0 {
+    meta["kafka-cluster"] = []string{kafkaClusterName}
+  }
+  if len(environment) > 0 {
+    meta["environment"] = []string{environment}
+  }
+  if chunkBuffer.Format != OUTPUT_FORMAT_PARQUET { // parquet rows aren't framed records
+    CurrentRecordLayout().AddTo(meta)
+  }
+  return meta
+}
+
+// InProgressKey is where the partition's unfinished buffer is mirrored, outside the topic's
+// prefix so offset recovery never lists it.
+func (chunkBuffer *ChunkBuffer) InProgressKey() string {
+  return fmt.Sprintf("%s%scurrent%s", S3_IN_PROGRESS_PREFIX, S3TopicPartitionPrefix(chunkBuffer.Topic, chunkBuffer.Partition), CodecSuffix(chunkBuffer.Compression))
+}
+
+func (chunkBuffer *ChunkBuffer) InProgressDue() bool {
+  if inProgressSeconds <= 0 || chunkBuffer.DeadLetter || chunkBuffer.length == chunkBuffer.inProgressLength {
+    return false
+  }
+  return time.Now().UnixNano() >= chunkBuffer.inProgressAt + inProgressSeconds * int64(time.Second)
+}
+
+// UploadInProgress overwrites the in-progress object with everything buffered so far, without
+// releasing the buffer.  Stream compressed buffers are flushed first, so the object is a
+// valid, if unterminated, stream.
+func (chunkBuffer *ChunkBuffer) UploadInProgress(destination Destination) error {
+  if flusher, ok := chunkBuffer.compressor.(interface{ Flush() error }); ok {
+    if err := flusher.Flush(); err != nil {
+      return err
+    }
+  }
+  contents, err := ioutil.ReadFile(chunkBuffer.File.Name())
+  if err != nil {
+    return err
+  }
+  contentType := CodecContentType(chunkBuffer.Compression)
+  if len(contentType) == 0 {
+    contentType = mime.TypeByExtension(filepath.Ext(chunkBuffer.File.Name()))
+  }
+
+  err = destination.Store(chunkBuffer.InProgressKey(), bytes.NewReader(contents), int64(len(contents)), contentType, chunkBuffer.Meta())
+  chunkBuffer.inProgressAt = time.Now().UnixNano()
+  if err == nil {
+    chunkBuffer.inProgressLength = chunkBuffer.length
+    chunkBuffer.Log().Debugf("Mirrored %d buffered messages (Offset:%d) to %s", chunkBuffer.messageCount, chunkBuffer.Offset, chunkBuffer.InProgressKey())
+  }
+  return err
+}
+
+func (chunkBuffer *ChunkBuffer) CheckpointDue() bool {
+  if checkpoints == nil || chunkBuffer.DeadLetter || chunkBuffer.messageCount == 0 || chunkBuffer.Offset == chunkBuffer.checkpointOffset {
+    return false
+  }
+  return time.Now().UnixNano() >= chunkBuffer.checkpointAt + checkpointIntervalSeconds * int64(time.Second)
+}
+
+// Checkpoint syncs the buffer file to disk and only then records its offset, so a leftover
+// buffer always holds every message up to the checkpoint.
+func (chunkBuffer *ChunkBuffer) Checkpoint() error {
+  chunkBuffer.checkpointAt = time.Now().UnixNano()
+  if flusher, ok := chunkBuffer.compressor.(interface{ Flush() error }); ok {
+    if err := flusher.Flush(); err != nil {
+      return err
+    }
+  }
+  if err := chunkBuffer.File.Sync(); err != nil {
+    return err
+  }
+  if err := checkpoints.Checkpoint(*chunkBuffer.Topic, chunkBuffer.Partition, chunkBuffer.Offset); err != nil {
+    return err
+  }
+  chunkBuffer.checkpointOffset = chunkBuffer.Offset
+  chunkBuffer.Log().Debugf("Checkpointed %s at Offset:%d", S3TopicPartitionPrefix(chunkBuffer.Topic, chunkBuffer.Partition), chunkBuffer.Offset)
+  return nil
+}
+
+func (chunkBuffer *ChunkBuffer) StoreToS3AndRelease(destination Destination) (bool, error) {
+  chunkBuffer.closeBufferFile()
+  
+  uploadStartedAt := time.Now()
+  s3path, err := chunkBuffer.Upload(destination)
+  if metrics != nil && (err != nil || len(s3path) > 0) {
+    metrics.Uploaded(*chunkBuffer.Topic, chunkBuffer.Partition, time.Since(uploadStartedAt), err)
+  }
+  if err != nil {
+    chunkBuffer.recordFailedUpload(err)
+    if retryQueue == nil {
+      panic(err)
+    }
+    chunkBuffer.Log().Warnf("Upload of bufferfile %s failed, moving it to the retry queue: %s", chunkBuffer.File.Name(), err)
+    if queueErr := retryQueue.Enqueue(chunkBuffer, err); queueErr != nil {
+      panic(queueErr)
+    }
+    if health != nil {
+      health.Failed(*chunkBuffer.Topic, chunkBuffer.Partition, err)
+    }
+    return false, err
+  }
+  if health != nil {
+    health.Flushed(*chunkBuffer.Topic, chunkBuffer.Partition)
+  }
+  if watermarks != nil && len(s3path) > 0 && !chunkBuffer.DeadLetter {
+    chunkBuffer.recordWatermark()
+  }
+  if len(s3path) > 0 && !chunkBuffer.DeadLetter {
+    chunkBuffer.recordUploadedOffset()
+  }
+
+  chunkBuffer.DeleteInProgress(destination) // superseded by the object just written
+  
+  if !keepBufferFiles {
+    chunkBuffer.Log().Debugf("Deleting bufferfile: %s", chunkBuffer.File.Name())
+    err = os.Remove(chunkBuffer.File.Name())
+    if err != nil {
+      chunkBuffer.Log().Warnf("Error deleting bufferfile %s: %#v", chunkBuffer.File.Name(), err)
+    }
+  }
+  
+  return true, nil
+}
+
+// DeleteInProgress deletes the buffer's in-progress object, if it mirrored one.  Every buffer of
+// the partition mirrors to the same key, so this must happen before its successor mirrors.
+func (chunkBuffer *ChunkBuffer) DeleteInProgress(destination Destination) {
+  if chunkBuffer.inProgressLength == 0 {
+    return
+  }
+  if err := destination.Delete(chunkBuffer.InProgressKey()); err != nil {
+    chunkBuffer.Log().Warnf("Couldn't delete in-progress object %s: %s", chunkBuffer.InProgressKey(), err)
+  }
+  chunkBuffer.inProgressLength = 0
+}
+
+// Upload writes the closed buffer file to a new key, returning the key, or "" when the
+// buffer was empty and there was nothing to write.
+func (chunkBuffer *ChunkBuffer) Upload(destination Destination) (string, error) {
+  bufferInfo, err := os.Stat(chunkBuffer.File.Name())
+  if err != nil {
+    return "", err
+  }
+  size := bufferInfo.Size()
+  
+  if size <= 0 || chunkBuffer.messageCount == 0 {
+    chunkBuffer.Log().Debugf("Nothing to store to s3 for bufferfile: %s", chunkBuffer.File.Name())
+    return "", nil
+  }
+
+  compression := chunkBuffer.Compression
+  // too small for compression to pay off, undo it (the retry queue doesn't know lengths)
+  undoCompression := len(compression) > 0 && chunkBuffer.length > 0 && chunkBuffer.length < compressMinBytes
+  blockCompress := blockCompressionRecords > 0 && size >= compressMinBytes
+
+  // Only buffers that get rewritten are read into memory, the rest are streamed from disk.
+  var contents []byte
+  if undoCompression || blockCompress || chunkBuffer.Format == OUTPUT_FORMAT_PARQUET {
+    // Reuse the read buffers across flushes, at our rotation rate allocating a fresh
+    // chunk-sized slice for every upload is most of the consumer's GC churn.
+    contentsBuffer := flushBufferPool.Get().(*bytes.Buffer)
+    contentsBuffer.Reset()
+    defer flushBufferPool.Put(contentsBuffer)
+
+    bufferFile, err := os.Open(chunkBuffer.File.Name())
+    if err != nil {
+      return "", err
+    }
+    _, err = contentsBuffer.ReadFrom(bufferFile)
+    bufferFile.Close()
+    if err != nil {
+      return "", err
+    }
+    contents = contentsBuffer.Bytes()
+  }
+
+  // Write to s3 in a new filename
+  suffix := ""
+  contentType := mime.TypeByExtension(filepath.Ext(chunkBuffer.File.Name()))
+  var blockIndex *BlockIndex
+  if undoCompression {
+    contents, err = DecompressS3Object(CodecSuffix(compression), contents)
+    if err != nil {
+      return "", err
+    }
+    compression = ""
+  }
+  if chunkBuffer.Format == OUTPUT_FORMAT_PARQUET { // parquet compresses its own columns
+    if len(compression) > 0 {
+      if contents, err = DecompressS3Object(CodecSuffix(compression), contents); err != nil {
+        return "", err
+      }
+    }
+    records, _ := SplitRecords(recordFraming, contents)
+    contents, err = ParquetFromRecords(TopicParquetSchema(*chunkBuffer.Topic), records)
+    if err != nil {
+      return "", err
+    }
+    blockIndex = &BlockIndex{}
+    suffix = S3_PARQUET_SUFFIX
+    contentType = PARQUET_CONTENT_TYPE
+  } else if blockCompress {
+    compressedBuffer := flushBufferPool.Get().(*bytes.Buffer)
+    compressedBuffer.Reset()
+    defer flushBufferPool.Put(compressedBuffer)
+
+    blockIndex, err = BlockGzip(contents, blockCompressionRecords, RecordOffsetParser(chunkBuffer.Format, CurrentRecordLayout().Header, chunkBuffer.Topic, chunkBuffer.Partition), compressedBuffer)
+    if err != nil {
+      return "", err
+    }
+    contents = compressedBuffer.Bytes()
+    suffix = S3_GZIP_SUFFIX
+    contentType = "application/x-gzip"
+  } else if len(compression) > 0 { // already compressed while it was written
+    blockIndex = &BlockIndex{Codec: compression}
+    suffix = CodecSuffix(compression)
+    contentType = CodecContentType(compression)
+  }
+
+  s3path, exists, err := chunkBuffer.NewS3Key(destination, suffix, chunkBuffer.firstOffset, chunkBuffer.Offset)
+  if err != nil {
+    return "", err
+  }
+  if exists {
+    chunkBuffer.Log().Infof("S3 Object %s already exists, skipping it (onkeyexists=skip)", s3path)
+    return s3path, nil
+  }
+
+  chunkBuffer.Log().Infof("Put Object: { Destination: %s, Key: %s, MimeType:%s }", destination.Name(), s3path, contentType)
+  
+  if contents == nil {
+    err = PutFileWithRetry(destination, s3path, chunkBuffer.File.Name(), size, contentType, chunkBuffer.Meta())
+  } else {
+    err = PutWithRetry(destination, s3path, contents, contentType, chunkBuffer.Meta())
+  }
+  if err != nil {
+    return "", err
+  }
+
+  if blockIndex == nil && chunkBuffer.Format == OUTPUT_FORMAT_RAW { // raw lines don't say their offset, the sidecar does
+    blockIndex = &BlockIndex{}
+  }
+  if blockIndex != nil { // only once the data object exists, so an index never points at nothing
+    blockIndex.Records = chunkBuffer.messageCount
+    blockIndex.FirstKafkaOffset = chunkBuffer.firstOffset
+    blockIndex.LastKafkaOffset = chunkBuffer.Offset
+    if err = PutIndexSidecar(destination, s3path, blockIndex); err != nil {
+      return "", err
+    }
+  }
+  if writeManifests {
+    if contents != nil {
+      size = int64(len(contents))
+    }
+    if err = PutManifestSidecar(destination, s3path, chunkBuffer.Manifest(size)); err != nil {
+      return "", err
+    }
+  }
+
+  if notifier != nil {
+    NotifyInBackground(notifier, &FlushEvent{
+      Bucket: destination.Name(),
+      Key: s3path,
+      Topic: *chunkBuffer.Topic,
+      Partition: chunkBuffer.Partition,
+      FirstOffset: chunkBuffer.firstOffset,
+      LastOffset: chunkBuffer.Offset,
+    })
+  }
+  return s3path, nil
+}
+
+// NewS3Key picks a key under the buffer's topic/partition and the date of its KeyTime.  The hostname goes
+// after the timestamp so keys still sort in the order they were written.  With
+// `deterministickeys` the key is just the zero padded offset range instead, so uploading the
+// same range again lands on the same object.  What happens when the key is taken is up to
+// `onkeyexists`: rename picks another timestamp, overwrite doesn't check, fail returns an
+// error and skip returns the key with exists set, for the caller to leave the object be.
+func (chunkBuffer *ChunkBuffer) NewS3Key(destination Destination, suffix string, firstOffset uint64, lastOffset uint64) (s3path string, exists bool, err error) {
+  for {
+    if deterministicKeys {
+      s3path = fmt.Sprintf("%s%s%020d-%020d%s", chunkBuffer.KeyPrefix(), S3TopicPartitionPrefix(chunkBuffer.Topic, chunkBuffer.Partition), firstOffset, lastOffset, suffix)
+    } else {
+      writeTime, keyTime := time.Now(), chunkBuffer.KeyTime()
+      s3path = fmt.Sprintf("%s%s%s%d%s%s", chunkBuffer.KeyPrefix(), S3TopicPartitionPrefix(chunkBuffer.Topic, chunkBuffer.Partition), S3TimePrefix(&keyTime), writeTime.UnixNano(), keyHostname, suffix)
+    }
+    if onKeyExists == ON_KEY_EXISTS_OVERWRITE {
+      return s3path, false, nil
+    }
+    exists, err = destination.Exists(s3path)
+    if err != nil || !exists {
+      return s3path, false, err
+    }
+    switch onKeyExists {
+    case ON_KEY_EXISTS_SKIP:
+      return s3path, true, nil
+    case ON_KEY_EXISTS_FAIL:
+      return "", false, fmt.Errorf("%s already exists and onkeyexists=fail", s3path)
+    }
+  }
+}
+
+// StoreOversizedMessage streams a message too big for any buffer straight to an object of its own
+// with PutReader, so it's never copied into a buffer file and read back into memory in one piece.
+func (chunkBuffer *ChunkBuffer) StoreOversizedMessage(destination Destination, msg KafkaMessage) error {
+  pieces := recordFraming.Frame(EncodeRecord(chunkBuffer.Format, chunkBuffer.Topic, chunkBuffer.Partition, msg.Offset(), msg.Payload()))
+  var size int64 = 0
+  for _, piece := range pieces {
+    size += int64(len(piece))
+  }
+
+  s3path, exists, err := chunkBuffer.NewS3Key(destination, "", msg.Offset(), msg.Offset())
+  if exists {
+    chunkBuffer.Log().Infof("S3 Object %s already exists, skipping it (onkeyexists=skip)", s3path)
+  } else if err == nil {
+    chunkBuffer.Log().Infof("Put Object: { Destination: %s, Key: %s, Size: %d }", destination.Name(), s3path, size)
+    err = RetryS3Put(s3path, func() error {
+      readers := make([]io.Reader, len(pieces))
+      for p, piece := range pieces {
+        readers[p] = bytes.NewReader(piece)
+      }
+      err := destination.Store(s3path, io.MultiReader(readers...), size, "", chunkBuffer.Meta())
+      if err == nil && confirmUploads {
+        hash := md5.New()
+        for _, piece := range pieces {
+          hash.Write(piece)
+        }
+        err = ConfirmUpload(destination, s3path, size, hash.Sum(nil))
+      }
+      return err
+    })
+  }
+  if err == nil && !exists && chunkBuffer.Format == OUTPUT_FORMAT_RAW { // raw lines don't say their offset, the sidecar does
+    err = PutIndexSidecar(destination, s3path, &BlockIndex{Records: 1, FirstKafkaOffset: msg.Offset(), LastKafkaOffset: msg.Offset()})
+  }
+  if err == nil && !exists && writeManifests {
+    now := time.Now().UnixNano() / int64(time.Millisecond)
+    err = PutManifestSidecar(destination, s3path, &Manifest{Topic: *chunkBuffer.Topic, Partition: chunkBuffer.Partition, FirstOffset: msg.Offset(), LastOffset: msg.Offset(), MessageCount: 1, Bytes: size, MinTimestamp: now, MaxTimestamp: now})
+  }
+
+  if err != nil {
+    oversized := &ChunkBuffer{Topic: chunkBuffer.Topic, Partition: chunkBuffer.Partition, firstOffset: msg.Offset(), Offset: msg.Offset(), messageCount: 1}
+    oversized.recordFailedUpload(err)
+    if retryQueue == nil {
+      panic(err)
+    }
+    // spill it into a buffer file of its own, that's what the retry queue knows how to hold
+    spill := chunkBuffer.Successor()
+    spill.CreateBufferFileOrPanic()
+    spill.PutMessage(msg)
+    spill.closeBufferFile()
+    chunkBuffer.Log().Warnf("Upload of oversized Offset:%d failed, moving it to the retry queue as %s: %s", msg.Offset(), spill.File.Name(), err)
+    if queueErr := retryQueue.Enqueue(spill, err); queueErr != nil {
+      panic(queueErr)
+    }
+  } else if notifier != nil && !exists {
+    NotifyInBackground(notifier, &FlushEvent{
+      Bucket: destination.Name(),
+      Key: s3path,
+      Topic: *chunkBuffer.Topic,
+      Partition: chunkBuffer.Partition,
+      FirstOffset: msg.Offset(),
+      LastOffset: msg.Offset(),
+    })
+  }
+
   chunkBuffer.Offset = msg.Offset()
-  chunkBuffer.File.Write(uuid)
-  chunkBuffer.File.Write(msg.Payload())
-  chunkBuffer.File.Write(lf)
+  if err == nil && watermarks != nil {
+    chunkBuffer.recordWatermark()
+  }
+  if err == nil {
+    chunkBuffer.recordUploadedOffset()
+  }
+  return err
+}
+
+func (chunkBuffer *ChunkBuffer) recordFailedUpload(cause error) {
+  if failedUploads == nil {
+    return
+  }
+  chunkBuffer.Log().Errorf("Upload of Offset:%d-%d failed all its attempts: %s", chunkBuffer.firstOffset, chunkBuffer.Offset, cause)
+  if err := failedUploads.Record(chunkBuffer, cause); err != nil {
+    chunkBuffer.Log().Errorf("Couldn't record failed upload in %s: %s", failedUploads.Path, err)
+  }
+}
+
+// recordUploadedOffset is only called once an upload has succeeded, so the offset cache is never
+// ahead of the destination.
+func (chunkBuffer *ChunkBuffer) recordUploadedOffset() {
+  if offsetCache == nil {
+    return
+  }
+  if err := offsetCache.Checkpoint(*chunkBuffer.Topic, chunkBuffer.Partition, chunkBuffer.Offset); err != nil {
+    chunkBuffer.Log().Warnf("Couldn't update offsetcheckpointpath %s: %s", offsetCache.Path, err)
+  }
+}
+
+func (chunkBuffer *ChunkBuffer) recordWatermark() {
+  if err := watermarks.Flushed(*chunkBuffer.Topic, chunkBuffer.Partition, chunkBuffer.Offset); err != nil {
+    chunkBuffer.Log().Warnf("Couldn't update watermarkfile %s: %s", watermarks.Path, err)
+  }
+}
 
-  chunkBuffer.length += int64(len(uuid)) + int64(len(msg.Payload())) + int64(len(lf))
+// Oversized messages don't fit in a buffer at all and are stored on their own.
+// Parquet buffers take every message, a lone payload streamed to S3 wouldn't be a parquet file.
+func (chunkBuffer *ChunkBuffer) Oversized(msg KafkaMessage) bool {
+  return int64(len(msg.Payload())) >= chunkBuffer.MaxSizeInBytes && chunkBuffer.Format != OUTPUT_FORMAT_PARQUET
 }
 
+func PutIndexSidecar(destination Destination, s3path string, index *BlockIndex) error {
+  indexJson, err := json.Marshal(index)
+  if err != nil {
+    return err
+  }
+  Log.Debugf("Put Object: { Destination: %s, Key: %s%s, Blocks: %d }", destination.Name(), s3path, S3_INDEX_SUFFIX, len(index.Blocks))
+  return PutWithRetry(destination, s3path + S3_INDEX_SUFFIX, indexJson, "application/json", nil)
+}
 
-func (chunkBuffer *ChunkBuffer) StoreToS3AndRelease(s3bucket *s3.Bucket) (bool, error) {
-  var s3path string
+// ConfirmUpload stats a freshly written object and checks that what the destination holds is
+// what we sent: the size always, and the MD5 whenever the destination reports one.
+func ConfirmUpload(destination Destination, s3path string, size int64, contentMD5 []byte) error {
+  storedSize, storedMD5, err := destination.Stat(s3path)
+  if err != nil {
+    return fmt.Errorf("couldn't confirm upload: %s", err)
+  }
+
+  if storedSize != size {
+    return fmt.Errorf("upload confirmation size mismatch, %s holds %d bytes but %d were sent", destination.Name(), storedSize, size)
+  }
+  if len(storedMD5) > 0 {
+    if expected := hex.EncodeToString(contentMD5); storedMD5 != expected {
+      return fmt.Errorf("upload confirmation MD5 mismatch, %s holds %s but %s was sent", destination.Name(), storedMD5, expected)
+    }
+  }
+  Log.Debugf("Confirmed upload of %s (%d bytes, MD5 %s)", s3path, storedSize, storedMD5)
+  return nil
+}
+
+func PutWithRetry(destination Destination, s3path string, contents []byte, contentType string, meta map[string][]string) error {
+  return RetryS3Put(s3path, func() error {
+    err := destination.Store(s3path, bytes.NewReader(contents), int64(len(contents)), contentType, meta)
+    if err == nil && confirmUploads {
+      sum := md5.Sum(contents)
+      err = ConfirmUpload(destination, s3path, int64(len(contents)), sum[:])
+    }
+    return err
+  })
+}
+
+// PutFileWithRetry is PutWithRetry streaming a file of the given size from disk, reopening it
+// for every attempt.
+func PutFileWithRetry(destination Destination, s3path string, filename string, size int64, contentType string, meta map[string][]string) error {
+  return RetryS3Put(s3path, func() error {
+    file, err := os.Open(filename)
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    err = destination.Store(s3path, file, size, contentType, meta)
+    if err == nil && confirmUploads {
+      hash := md5.New()
+      if _, err = file.Seek(0, 0); err == nil {
+        _, err = io.Copy(hash, file)
+      }
+      if err == nil {
+        err = ConfirmUpload(destination, s3path, size, hash.Sum(nil))
+      }
+    }
+    return err
+  })
+}
+
+// RetryS3Put retries transient put failures with exponential backoff, capped at
+// `retrymaxbackoffmillis` and optionally with full jitter, before giving up.
+func RetryS3Put(s3path string, put func() error) error {
   var err error
+  backoff := S3_PUT_INITIAL_BACKOFF
+  for attempt := 1; attempt <= S3_PUT_ATTEMPTS; attempt++ {
+    err = put()
+    if err == nil {
+      return nil
+    }
+    Log.Warnf("S3 Put of %s failed (attempt %d/%d): %s", s3path, attempt, S3_PUT_ATTEMPTS, err)
+    if attempt < S3_PUT_ATTEMPTS {
+      if s3RetryMaxBackoff > 0 && backoff > s3RetryMaxBackoff {
+        backoff = s3RetryMaxBackoff
+      }
+      if s3RetryJitter { // full jitter, so uploaders throttled together don't retry together
+        time.Sleep(time.Duration(rand.Int63n(int64(backoff) + 1)))
+      } else {
+        time.Sleep(backoff)
+      }
+      backoff *= 2
+    }
+  }
+  return err
+}
+
+func LastS3KeyWithPrefix(destination Destination, prefix *string) (string, error) {
+  keys, err := LastS3KeysWithPrefix(destination, prefix, 1)
+  if err != nil || len(keys) == 0 { return "", err }
+  return keys[0], nil
+}
+
+// ListS3 is destination.List, but never more than `s3maxlistconcurrency` at once across the
+// whole process, LIST requests get throttled separately from GETs and PUTs.
+func ListS3(destination Destination, prefix string, marker string) (*DestinationListing, error) {
+  if s3ListSlots != nil {
+    s3ListSlots <- true
+    defer func() { <-s3ListSlots }()
+  }
+  return destination.List(prefix, marker)
+}
+
+// LastS3KeysWithPrefix returns up to count of the latest keys under prefix, latest first.
+func LastS3KeysWithPrefix(destination Destination, prefix *string, count int) ([]string, error) {
+  window := make([]string, 0, count)
+
+  // First, walk back over the last 14 days' prefixes, which is all most partitions need.  Only
+  // when dateformat names whole days, anything finer would skip the hours in between.
+  currentDay := time.Now().UTC()
+  startOfDay := time.Date(currentDay.Year(), currentDay.Month(), currentDay.Day(), 0, 0, 0, 0, time.UTC)
+  endOfDay := startOfDay.Add(time.Duration(DAY_IN_SECONDS - 1) * time.Second)
+  if S3DatePrefix(&startOfDay) == S3DatePrefix(&endOfDay) {
+    for i := 0; i < S3_REWIND_IN_DAYS_BEFORE_LONG_LOOP && len(window) < count; i++ {
+      dayKeys, err := S3KeysForDay(destination, *prefix, currentDay, count - len(window))
+      if err != nil { return nil, err }
+      window = append(dayKeys, window...)
+      currentDay = currentDay.AddDate(0, 0, -1)
+    }
+  }
+
+  // Otherwise just loop forward until there aren't any more results
+  if len(window) == 0 {
+    keyMarker := ""
+    for moreResults := true; moreResults; {
+      results, err := ListS3(destination, *prefix, keyMarker)
+      if err != nil { return nil, err }
+      
+      if len(results.Contents) == 0 { // empty request, the window holds the last found keys
+        break
+      }
+      
+      for _, key := range results.Contents {
+        if IsSidecarKey(key.Key) { continue }
+        window = append(window, key.Key)
+      }
+      if len(window) > count {
+        window = window[len(window)-count:]
+      }
+      keyMarker = results.Contents[len(results.Contents)-1].Key
+      moreResults = results.IsTruncated
+    }
+  }
+  if len(window) > count {
+    window = window[len(window)-count:]
+  }
+
+  lastKeys := make([]string, len(window))
+  for k := range window {
+    lastKeys[k] = window[len(window)-1-k]
+  }
+  return lastKeys, nil
+}
+
+// S3KeysForDay lists the keys under prefix for day, in order.  With pathgranularity=hour a day
+// too busy for one LIST is listed an hour at a time instead, latest first, stopping once it
+// has count keys rather than listing the whole day.
+func S3KeysForDay(destination Destination, prefix string, day time.Time, count int) ([]string, error) {
+  dayPrefix := prefix + S3DatePrefix(&day)
+  if pathGranularity != PATH_GRANULARITY_HOUR {
+    return S3KeysWithPrefix(destination, dayPrefix)
+  }
+  results, err := ListS3(destination, dayPrefix, "")
+  if err != nil { return nil, err }
+  keys := make([]string, 0)
+  if !results.IsTruncated {
+    for _, key := range results.Contents {
+      if IsSidecarKey(key.Key) { continue }
+      keys = append(keys, key.Key)
+    }
+    return keys, nil
+  }
+  for hour := 23; hour >= 0 && len(keys) < count; hour-- {
+    hourKeys, err := S3KeysWithPrefix(destination, fmt.Sprintf("%s%02d/", dayPrefix, hour))
+    if err != nil { return nil, err }
+    keys = append(hourKeys, keys...)
+  }
+  return keys, nil
+}
+
+// S3KeysWithPrefix lists every key under prefix, sidecars aside, in order.
+func S3KeysWithPrefix(destination Destination, prefix string) ([]string, error) {
+  keys := make([]string, 0)
+  keyMarker := ""
+  for moreResults := true; moreResults; {
+    results, err := ListS3(destination, prefix, keyMarker)
+    if err != nil { return nil, err }
+    if len(results.Contents) == 0 {
+      break
+    }
+    for _, key := range results.Contents {
+      if IsSidecarKey(key.Key) { continue }
+      keys = append(keys, key.Key)
+    }
+    keyMarker = results.Contents[len(results.Contents)-1].Key
+    moreResults = results.IsTruncated
+  }
+  return keys, nil
+}
+
+// LastOffsetInS3Object scans an object backwards for the last well formed guid line of the
+// topic/partition.  Lines that don't parse (e.g. a truncated write) are skipped rather than
+// trusted, so found is false when the object holds no usable offset at all.  Records are read
+// in the framing and header the object was stored with, not the ones configured now.
+func LastOffsetInS3Object(destination Destination, key string, topic *string, partition int64) (offset uint64, found bool, err error) {
+  parseOffset := RecordOffsetParser(TopicOutputFormat(*topic), "", topic, partition)
+  if IsCompressedKey(key) || parseOffset == nil { // the sidecar index saves downloading and decompressing the whole object
+    indexBytes, err := destination.Get(key + S3_INDEX_SUFFIX)
+    var index BlockIndex
+    if err == nil && json.Unmarshal(indexBytes, &index) == nil && index.Records > 0 {
+      Log.Debugf("    Offset:%d from sidecar %s%s", index.LastKafkaOffset, key, S3_INDEX_SUFFIX)
+      return index.LastKafkaOffset, true, nil
+    }
+    if parseOffset == nil {
+      Log.Warnf("    No sidecar for raw object %s, it can't be scanned for offsets", key)
+      return 0, false, nil
+    }
+  }
+  layout, err := ObjectRecordLayout(destination, key)
+  if err != nil {
+    return 0, false, err
+  }
+  parseOffset = RecordOffsetParser(TopicOutputFormat(*topic), layout.Header, topic, partition)
+
+  // only the end of the object is needed, but length prefixes can't be found from the middle
+  if _, newlines := layout.Framing.(NewlineFraming); newlines && recoveryTailBytes > 0 && !IsCompressedKey(key) {
+    for tail := recoveryTailBytes; ; tail *= 4 {
+      tailBytes, wholeObject, err := destination.GetTail(key, tail)
+      if err != nil {
+        return 0, false, err
+      }
+      if !wholeObject { // most likely starts mid-line
+        tailBytes = tailBytes[bytes.IndexByte(tailBytes, '\n') + 1:]
+      }
+      records, _ := SplitRecords(layout.Framing, tailBytes)
+      if offset, found := LastRecordOffset(records, parseOffset); found || wholeObject {
+        return offset, found, nil
+      }
+      Log.Debugf("    No complete guid line in the last %d bytes of %s, fetching more", tail, key)
+    }
+  }
+
+  contentBytes, err := destination.Get(key)
+  if err != nil {
+    return 0, false, err
+  }
+  contentBytes, err = DecompressS3Object(key, contentBytes)
+  if err != nil {
+    return 0, false, err
+  }
+
+  records, _ := SplitRecords(layout.Framing, contentBytes)
+  offset, found = LastRecordOffset(records, parseOffset)
+  return offset, found, nil
+}
+
+// LastRecordOffset scans records backwards for the last one parseOffset can read an offset from.
+func LastRecordOffset(records [][]byte, parseOffset func(line string) (uint64, bool)) (uint64, bool) {
+  for l := len(records)-1; l >= 0; l-- {
+    Log.Debugf("    Looking at Line '%s'", records[l])
+    if offset, ok := parseOffset(string(records[l])); ok { // found a line with an offset, escape out
+      Log.Debugf("    Offset:%d(L#%d)", offset, l)
+      return offset, true
+    }
+  }
+  return 0, false
+}
+
+// S3OffsetRecovery is what offset recovery found in S3 for one topic/partition.
+type S3OffsetRecovery struct {
+  Offset   uint64
+  Archived bool // some object held an offset
+  Err      error
+}
+
+// RecoverS3Offset finds the last offset archived in the last scanObjects objects of a
+// topic/partition, taking the max over all of them so that one bad object can't rewind us.
+// When none of them hold an offset it looks further back, 4 times as far each time, and when
+// no object it can find does, it's an error: resuming at 0 would archive the partition again.
+func RecoverS3Offset(destination Destination, topic *string, partition int64, scanObjects int) *S3OffsetRecovery {
+  prefix := S3TopicPartitionPrefix(topic, partition)
+  recovery := &S3OffsetRecovery{}
+  scanned := 0
+  for scan := scanObjects; ; scan *= 4 {
+    latestKeys, err := LastS3KeysWithPrefix(destination, &prefix, scan)
+    if err != nil {
+      return &S3OffsetRecovery{Err: err}
+    }
+    if len(latestKeys) == 0 { // no files written, so start at the beginning
+      return recovery
+    }
+    Log.Debugf("  Looking at %s object versions, got: %#v", prefix, latestKeys[scanned:])
+
+    for _, latestKey := range latestKeys[scanned:] {
+      Log.Debugf("  Found s3 object %s, scanning for offset", latestKey)
+      offset, found, err := LastOffsetInS3Object(destination, latestKey, topic, partition)
+      if err != nil {
+        Log.Warnf("  Couldn't read s3 object %s for offset recovery, skipping it: %s", latestKey, err)
+        continue
+      }
+      if !found {
+        Log.Warnf("  No valid guid line in s3 object %s, skipping it", latestKey)
+        continue
+      }
+      if !recovery.Archived || offset > recovery.Offset {
+        recovery.Offset, recovery.Archived = offset, true
+      }
+    }
+    if recovery.Archived {
+      return recovery
+    }
+    if len(latestKeys) < scan || scan >= S3_RECOVERY_MAX_SCAN_OBJECTS {
+      return &S3OffsetRecovery{Err: fmt.Errorf("none of the last %d objects under %s hold an offset to resume from", len(latestKeys), prefix)}
+    }
+    Log.Warnf("  None of the last %d objects under %s hold an offset, looking further back", len(latestKeys), prefix)
+    scanned = len(latestKeys)
+  }
+}
+
+// AWSAuth is accesskey and secretkey when they're set.  Otherwise goamz looks for credentials:
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, then the EC2 instance's IAM role, then
+// ~/.aws/credentials.  useIAMRole goes straight to the role.  Role credentials expire, so they
+// come with a session token and expiration, and the Auth's Token() fetches fresh ones when a
+// request is signed in the last 30 seconds before then, which keeps a long run signing with
+// current credentials.
+func AWSAuth(accessKey string, secretKey string, useIAMRole bool) (aws.Auth, error) {
+  if !useIAMRole {
+    return aws.GetAuth(accessKey, secretKey, "", time.Time{})
+  }
+  cred, err := aws.GetInstanceCredentials()
+  if err != nil {
+    return aws.Auth{}, err
+  }
+  expiration, err := time.Parse("2006-01-02T15:04:05Z", cred.Expiration)
+  if err != nil {
+    return aws.Auth{}, fmt.Errorf("can't read the role credentials' expiration `%s`: %s", cred.Expiration, err)
+  }
+  return *aws.NewAuth(cred.AccessKeyId, cred.SecretAccessKey, cred.Token, expiration), nil
+}
+
+// S3EndpointRegion is a region for an S3 compatible store (MinIO, Ceph) at endpoint, which every
+// request then goes to.  Path style addresses a bucket as <endpoint>/<bucket>, otherwise it's
+// <bucket>.<endpoint's host>, as on AWS.
+func S3EndpointRegion(name string, endpoint string, pathStyle bool) (aws.Region, error) {
+  endpointUrl, err := url.Parse(endpoint)
+  if err != nil || len(endpointUrl.Scheme) == 0 || len(endpointUrl.Host) == 0 {
+    return aws.Region{}, fmt.Errorf("`%s` isn't a URL like https://minio.example.com:9000", endpoint)
+  }
+  if len(name) == 0 {
+    name = "us-east-1"
+  }
+  region := aws.Region{Name: name, S3Endpoint: strings.TrimSuffix(endpoint, "/")}
+  if !pathStyle {
+    region.S3BucketEndpoint = endpointUrl.Scheme + "://${bucket}." + endpointUrl.Host
+  }
+  return region, nil
+}
+
+// S3ClockSkew is how far the local clock is ahead of S3's (behind when negative), from the
+// Date header of a request to the bucket.  Any response will do, so it needn't be signed.
+// The header has a resolution of a second, which is plenty for catching a broken NTP.
+func S3ClockSkew(bucket *s3.Bucket) (time.Duration, error) {
+  sentAt := time.Now()
+  response, err := http.Head(bucket.URL(""))
+  if err != nil {
+    return 0, err
+  }
+  response.Body.Close()
+  receivedAt := time.Now()
+  s3Time, err := http.ParseTime(response.Header.Get("Date"))
+  if err != nil {
+    return 0, fmt.Errorf("S3 sent no usable Date header: %s", err)
+  }
+  return sentAt.Add(receivedAt.Sub(sentAt) / 2).Sub(s3Time), nil
+}
+
+// AbortIncompleteUploads aborts multipart uploads under prefix that were started over olderThan
+// ago, judging by the nanosecond timestamp our keys are named after (goamz's ListMulti doesn't
+// report when an upload was initiated).  Uploads of keys we didn't name are left alone, and so
+// are `deterministickeys` ones, whose 20 digit zero padded offsets would read as ancient times.
+func AbortIncompleteUploads(bucket *s3.Bucket, prefix string, olderThan time.Duration) (int, error) {
+  multis, _, err := bucket.ListMulti(prefix, "")
+  if err != nil {
+    return 0, err
+  }
+  aborted := 0
+  for _, multi := range multis {
+    name := filepath.Base(multi.Key)
+    if dash := strings.IndexAny(name, "-."); dash >= 0 {
+      name = name[:dash]
+    }
+    startedNanos, err := strconv.ParseInt(name, 10, 64)
+    if err != nil || len(name) != UNIX_NANO_DIGITS {
+      Log.Debugf("  Leaving incomplete upload of %s alone, can't tell its age", multi.Key)
+      continue
+    }
+    age := time.Since(time.Unix(0, startedNanos))
+    if age < olderThan {
+      continue
+    }
+    if err = multi.Abort(); err != nil {
+      return aborted, err
+    }
+    Log.Infof("Aborted incomplete upload of %s (UploadId %s), started %s ago", multi.Key, multi.UploadId, age)
+    aborted++
+  }
+  return aborted, nil
+}
+
+// IsOffsetOutOfRange is whether err is the broker refusing a fetch at an offset it doesn't
+// hold, which the 0.7 client only reports as the error code in its message.
+func IsOffsetOutOfRange(err error) bool {
+  return err != nil && strings.HasSuffix(err.Error(), fmt.Sprintf("Error: %d", KAFKA_ERROR_OFFSET_OUT_OF_RANGE))
+}
+
+// KafkaOffsetBoundary asks the broker for the earliest or latest offset of a partition.
+func KafkaOffsetBoundary(hostname string, topic *string, partition int64, which int64) (uint64, error) {
+  offsets, err := kafka.NewBrokerOffsetConsumer(hostname, *topic, int(partition)).GetOffsets(which, 1)
+  if err != nil {
+    return 0, err
+  }
+  if len(offsets) == 0 {
+    return 0, fmt.Errorf("no offsets returned for %s#%d", *topic, partition)
+  }
+  return offsets[0], nil
+}
+
+func main() {
+  flag.Parse()  // Read argv
+  
+  if shouldOutputVersion {
+    fmt.Printf("kafka-s3-consumer %s\n", VERSION)
+    os.Exit(0)
+  }
+  
+  config, err := configfile.ReadConfigFile(configFilename)
+  if err != nil {
+    Log.Errorf("Couldn't read config file %s because: %#v", configFilename, err)
+    panic(err)
+  }
+  if err = ValidateConfig(config); err != nil {
+    Log.Errorf("Invalid config file %s: %s", configFilename, err)
+    os.Exit(1)
+  }
   
+  // Read configuration file
+  host, _ := config.GetString("kafka", "host")
+  debug, _ = config.GetBool("default", "debug")
   if debug {
-    fmt.Printf("Closing bufferfile: %s\n", chunkBuffer.File.Name())
+    logLevel = LOG_DEBUG
+  }
+  if config.HasOption("default", "loglevel") {
+    configuredLogLevel, _ := config.GetString("default", "loglevel")
+    level, ok := ParseLogLevel(configuredLogLevel)
+    if !ok {
+      Log.Errorf("Invalid loglevel `%s` in config file %s, must be one of DEBUG, INFO, WARN or ERROR", configuredLogLevel, configFilename)
+      os.Exit(1)
+    }
+    logLevel = level
+  }
+  debug = logLevel == LOG_DEBUG
+  bufferMaxSizeInByes, _ := config.GetInt64("default", "maxchunksizebytes")
+  bufferMaxAgeInMinutes, _ := config.GetInt64("default", "maxchunkagemins")
+  bufferMaxLatencySeconds, _ := config.GetInt64("default", "maxbufferlatencyseconds")
+  flushTickInterval := FLUSH_TICK_INTERVAL
+  if flushIntervalSeconds, _ := config.GetInt64("default", "flushintervalseconds"); flushIntervalSeconds > 0 {
+    flushTickInterval = time.Duration(flushIntervalSeconds) * time.Second
+  }
+  coordinatedFlush, _ := config.GetBool("default", "coordinatedflush")
+  flushBoundarySeconds, _ := config.GetInt64("default", "flushboundaryseconds")
+  flushBoundary := time.Duration(flushBoundarySeconds) * time.Second
+  bufferMinMessages, _ := config.GetInt64("default", "minmessagesperobject")
+  bufferMinSizeInBytes, _ := config.GetInt64("default", "minchunksizebytes")
+  bufferMaxHardAgeInMinutes, _ := config.GetInt64("default", "maxchunkhardagemins")
+  environment, _ = config.GetString("default", "environment")
+  environment = strings.Trim(environment, "/")
+  inProgressSeconds, _ = config.GetInt64("default", "inprogressseconds")
+  blockCompressionRecords, _ = config.GetInt64("default", "blockcompressionrecords")
+  compressMinBytes, _ = config.GetInt64("default", "compressminbytes")
+  streamCompression, _ := config.GetString("default", "streamcompression")
+  switch streamCompression {
+  case "none":
+    streamCompression = ""
+  case "", "gzip", "zstd", "snappy":
+  default:
+    Log.Errorf("Invalid streamcompression `%s` in config file %s, must be one of none, gzip, zstd or snappy", streamCompression, configFilename)
+    os.Exit(1)
+  }
+  if len(streamCompression) > 0 && blockCompressionRecords > 0 {
+    Log.Errorf("streamcompression and blockcompressionrecords can't both be set in config file %s", configFilename)
+    os.Exit(1)
+  }
+  // `compress` is the simple switch, gzip unless a way of compressing was chosen explicitly
+  if compress, _ := config.GetBool("default", "compress"); compress && len(streamCompression) == 0 && blockCompressionRecords == 0 {
+    streamCompression = "gzip"
+  }
+  ingestTimestamps, _ = config.GetBool("default", "ingesttimestamps")
+  writeManifests, _ = config.GetBool("default", "writemanifest")
+  if configuredFormat, _ := config.GetString("default", "outputformat"); len(configuredFormat) > 0 {
+    defaultOutputFormat = configuredFormat
+  }
+  if !ValidOutputFormat(defaultOutputFormat) {
+    Log.Errorf("Invalid outputformat `%s` in config file %s, must be one of legacy, jsonl, raw or parquet", defaultOutputFormat, configFilename)
+    os.Exit(1)
+  }
+  for _, section := range config.GetSections() {
+    if !strings.HasPrefix(section, "topic:") || !config.HasOption(section, "outputformat") { continue }
+    topicFormat, _ := config.GetString(section, "outputformat")
+    if !ValidOutputFormat(topicFormat) {
+      Log.Errorf("Invalid outputformat `%s` in section [%s] of config file %s, must be one of legacy, jsonl, raw or parquet", topicFormat, section, configFilename)
+      os.Exit(1)
+    }
+    outputFormats[strings.TrimPrefix(section, "topic:")] = topicFormat
+  }
+  parquetSchemaPaths := make(map[string]string)
+  parquetSchemaPaths[""], _ = config.GetString("default", "parquetschema")
+  for _, section := range config.GetSections() {
+    if strings.HasPrefix(section, "topic:") && config.HasOption(section, "parquetschema") {
+      parquetSchemaPaths[strings.TrimPrefix(section, "topic:")], _ = config.GetString(section, "parquetschema")
+    }
+  }
+  for topic, schemaPath := range parquetSchemaPaths {
+    if len(schemaPath) == 0 { continue }
+    schema, err := ReadParquetSchema(schemaPath)
+    if err != nil {
+      Log.Errorf("%s", err)
+      os.Exit(1)
+    }
+    if len(topic) == 0 {
+      defaultParquetSchema = schema
+    } else {
+      parquetSchemas[topic] = schema
+    }
+  }
+  if rowGroupBytes, _ := config.GetInt64("default", "parquetrowgroupbytes"); rowGroupBytes > 0 {
+    parquetRowGroupBytes = rowGroupBytes
+  }
+  defaultSchemaVersion, _ = config.GetString("default", "schemaversion")
+  for _, section := range config.GetSections() {
+    if strings.HasPrefix(section, "topic:") && config.HasOption(section, "schemaversion") {
+      schemaVersions[strings.TrimPrefix(section, "topic:")], _ = config.GetString(section, "schemaversion")
+    }
+  }
+  configuredFraming, _ := config.GetString("default", "framing")
+  framing, validFraming := FramingNamed(configuredFraming)
+  if validFraming {
+    recordFraming = framing
+  } else {
+    Log.Errorf("Invalid framing `%s` in config file %s, must be one of newline, lengthprefixed or varint", configuredFraming, configFilename)
+    os.Exit(1)
+  }
+  recordHeader, _ := config.GetString("default", "recordheader")
+  switch recordHeader {
+  case "", RECORD_HEADER_TEXT:
+  case RECORD_HEADER_COMPACT:
+    if configuredFraming == "" || configuredFraming == FRAMING_NEWLINE {
+      Log.Errorf("recordheader=compact is binary and needs framing=lengthprefixed or varint in config file %s", configFilename)
+      os.Exit(1)
+    }
+    compactRecordHeader = true
+  default:
+    Log.Errorf("Invalid recordheader `%s` in config file %s, must be one of text or compact", recordHeader, configFilename)
+    os.Exit(1)
+  }
+  recordChecksumRaw, _ := config.GetString("default", "recordchecksum")
+  switch recordChecksumRaw {
+  case "", "none":
+  case "crc32c":
+    recordChecksum = true
+  default:
+    Log.Errorf("Invalid recordchecksum `%s` in config file %s, must be one of none or crc32c", recordChecksumRaw, configFilename)
+    os.Exit(1)
+  }
+  port, _ := config.GetString("kafka", "port")
+  kafkaClusterName, _ = config.GetString("kafka", "kafkaclustername")
+  hostname := fmt.Sprintf("%s:%s", host, port)
+  awsKey, _ := config.GetString("s3", "accesskey")
+  awsSecret, _ := config.GetString("s3", "secretkey")
+  useIAMRole, _ := config.GetBool("s3", "useiamrole")
+  if useIAMRole && (len(awsKey) > 0 || len(awsSecret) > 0) {
+    Log.Errorf("useiamrole=true can't be combined with accesskey or secretkey in config file %s", configFilename)
+    os.Exit(1)
+  }
+  awsRegion, _ := config.GetString("s3", "region")
+  s3BucketName, _ := config.GetString("s3", "bucket")
+  partitionWidth, _ := config.GetInt64("s3", "partitionwidth")
+  if configuredDateFormat, _ := config.GetString("s3", "dateformat"); len(configuredDateFormat) > 0 {
+    dateFormat = configuredDateFormat
+  }
+  if configuredPartitionBy, _ := config.GetString("s3", "partitionby"); len(configuredPartitionBy) > 0 {
+    if configuredPartitionBy != PARTITION_BY_UPLOAD_TIME && configuredPartitionBy != PARTITION_BY_MESSAGE_TIME {
+      Log.Errorf("Invalid partitionby `%s` in config file %s, must be one of uploadtime or messagetime", configuredPartitionBy, configFilename)
+      os.Exit(1)
+    }
+    partitionBy = configuredPartitionBy
+  }
+  if configuredGranularity, _ := config.GetString("s3", "pathgranularity"); len(configuredGranularity) > 0 {
+    if configuredGranularity != PATH_GRANULARITY_DAY && configuredGranularity != PATH_GRANULARITY_HOUR {
+      Log.Errorf("Invalid pathgranularity `%s` in config file %s, must be one of day or hour", configuredGranularity, configFilename)
+      os.Exit(1)
+    }
+    pathGranularity = configuredGranularity
+  }
+  if maxListConcurrency, _ := config.GetInt64("s3", "s3maxlistconcurrency"); maxListConcurrency > 0 {
+    s3ListSlots = make(chan bool, maxListConcurrency)
+  }
+  confirmUploads, _ = config.GetBool("s3", "confirmuploads")
+  deterministicKeys, _ = config.GetBool("s3", "deterministickeys")
+  onKeyExists, _ = config.GetString("s3", "onkeyexists")
+  switch onKeyExists {
+  case "": // what keys did before there was a choice
+    if deterministicKeys {
+      onKeyExists = ON_KEY_EXISTS_OVERWRITE
+    } else {
+      onKeyExists = ON_KEY_EXISTS_RENAME
+    }
+  case ON_KEY_EXISTS_RENAME:
+    if deterministicKeys {
+      Log.Errorf("onkeyexists=rename can't be combined with deterministickeys in config file %s", configFilename)
+      os.Exit(1)
+    }
+  case ON_KEY_EXISTS_OVERWRITE, ON_KEY_EXISTS_SKIP, ON_KEY_EXISTS_FAIL:
+  default:
+    Log.Errorf("Invalid onkeyexists `%s` in config file %s, must be one of rename, overwrite, skip or fail", onKeyExists, configFilename)
+    os.Exit(1)
+  }
+  clusterInKey, _ = config.GetBool("s3", "clusterinkey")
+  if clusterInKey && len(kafkaClusterName) == 0 {
+    Log.Errorf("clusterinkey needs kafkaclustername in the [kafka] section of config file %s", configFilename)
+    os.Exit(1)
+  }
+  retryMaxBackoffMillis, _ := config.GetInt64("s3", "retrymaxbackoffmillis")
+  s3RetryMaxBackoff = time.Duration(retryMaxBackoffMillis) * time.Millisecond
+  s3RetryJitter, _ = config.GetBool("s3", "retryjitter")
+  rand.Seed(time.Now().UnixNano()) // or every instance jitters identically
+  if sanitizeTopics, _ := config.GetBool("s3", "topicsanitize"); sanitizeTopics {
+    replacement := "_"
+    if config.HasOption("s3", "topicsanitizereplacement") {
+      replacement, _ = config.GetString("s3", "topicsanitizereplacement")
+    }
+    if strings.Contains(replacement, "/") {
+      Log.Errorf("Invalid topicsanitizereplacement `%s` in config file %s, it can't contain /", replacement, configFilename)
+      os.Exit(1)
+    }
+    topicSanitizeReplacement = &replacement
+  }
+  topicPrefixesRaw, _ := config.GetString("s3", "topicprefixes")
+  for _, mapping := range strings.Split(topicPrefixesRaw, ",") {
+    if len(strings.TrimSpace(mapping)) == 0 { continue }
+    topicAndPrefix := strings.SplitN(mapping, ":", 2)
+    if len(topicAndPrefix) != 2 || len(strings.Trim(strings.TrimSpace(topicAndPrefix[1]), "/")) == 0 {
+      Log.Errorf("Invalid topicprefixes entry `%s` in config file %s, expected topic:prefix", mapping, configFilename)
+      os.Exit(1)
+    }
+    topicPrefixes[strings.TrimSpace(topicAndPrefix[0])] = strings.Trim(strings.TrimSpace(topicAndPrefix[1]), "/")
   }
-  chunkBuffer.File.Close()
-  
-  contents, err := ioutil.ReadFile(chunkBuffer.File.Name())
-  if err != nil {
-    return false, err
+  partitionPadWidth = int(partitionWidth)
+  if useKeyHostname, _ := config.GetBool("s3", "keyhostname"); useKeyHostname {
+    machineName, err := os.Hostname()
+    if err != nil {
+      Log.Errorf("Couldn't get the hostname for keyhostname because: %#v", err)
+      panic(err)
+    }
+    keyHostname = "-" + strings.Replace(machineName, "/", "_", -1)
   }
-  
-  if len(contents) <= 0 {
-    if debug {
-      fmt.Printf("Nothing to store to s3 for bufferfile: %s\n", chunkBuffer.File.Name())
-    }
-  } else {  // Write to s3 in a new filename
-    alreadyExists := true
-    for alreadyExists {
-      writeTime := time.Now()
-      s3path = fmt.Sprintf("%s%s%d", S3TopicPartitionPrefix(chunkBuffer.Topic, chunkBuffer.Partition), S3DatePrefix(&writeTime), writeTime.UnixNano())
-      alreadyExists, err = s3bucket.Exists(s3path)
-      if err != nil {
-        panic(err)
-        return false, err
+  s3Endpoint, _ := config.GetString("s3", "endpoint")
+  region := aws.Regions[awsRegion] // ValidateConfig checked it's there
+  if len(s3Endpoint) > 0 {
+    pathStyle, _ := config.GetBool("s3", "pathstyle")
+    if region, err = S3EndpointRegion(awsRegion, s3Endpoint, pathStyle); err != nil {
+      Log.Errorf("Invalid endpoint in config file %s: %s", configFilename, err)
+      os.Exit(1)
+    }
+  }
+  var destination Destination
+  var s3bucket *s3.Bucket // nil unless destination=s3, for what only S3 has
+  destinationType, _ := config.GetString("default", "destination")
+  switch destinationType {
+  case "", DESTINATION_S3:
+    awsAuth, err := AWSAuth(awsKey, awsSecret, useIAMRole)
+    if err != nil {
+      Log.Errorf("Couldn't find AWS credentials for the bucket because: %s", err)
+      os.Exit(1)
+    }
+    s3client := s3.New(awsAuth, region)
+    // goamz puts the read timeout on the connection as a deadline, so it bounds the whole
+    // request and a hung connection can't wedge an uploader
+    if requestTimeoutSeconds, _ := config.GetInt64("s3", "s3requesttimeoutseconds"); requestTimeoutSeconds > 0 {
+      s3client.ConnectTimeout = time.Duration(requestTimeoutSeconds) * time.Second
+      s3client.ReadTimeout = time.Duration(requestTimeoutSeconds) * time.Second
+    }
+    s3bucket = s3client.Bucket(s3BucketName)
+    sse, _ := config.GetString("s3", "sse")
+    sseKmsKeyId, _ := config.GetString("s3", "ssekmskeyid")
+    switch sse {
+    case "", SSE_NONE, SSE_AES256:
+    case SSE_KMS:
+      if len(sseKmsKeyId) == 0 {
+        Log.Errorf("sse=aws:kms needs ssekmskeyid in the [s3] section of config file %s", configFilename)
+        os.Exit(1)
       }
-    } 
+    default:
+      Log.Errorf("Invalid sse `%s` in config file %s, must be one of none, AES256 or aws:kms", sse, configFilename)
+      os.Exit(1)
+    }
+    s3Destination := &S3Destination{Bucket: s3bucket, SSE: sse, SSEKMSKeyId: sseKmsKeyId, TopicStorageClasses: make(map[string]string)}
+    s3Destination.StorageClass, _ = config.GetString("s3", "storageclass")
+    storageClassSections := map[string]string{"s3": s3Destination.StorageClass}
+    for _, section := range config.GetSections() {
+      if strings.HasPrefix(section, "topic:") && config.HasOption(section, "storageclass") {
+        topic := strings.TrimPrefix(section, "topic:")
+        storageClassSections[section], _ = config.GetString(section, "storageclass")
+        s3Destination.TopicStorageClasses[S3TopicPrefix(&topic)] = storageClassSections[section]
+      }
+    }
+    for section, storageClass := range storageClassSections {
+      if len(storageClass) == 0 { continue }
+      if !ValidStorageClass(storageClass) {
+        Log.Errorf("Invalid storageclass `%s` in section [%s] of config file %s, must be one of %s", storageClass, section, configFilename, strings.Join(storageClasses, ", "))
+        os.Exit(1)
+      }
+      // recovery reads the last objects of every partition, and would fail on these
+      if !ReadableStorageClass(storageClass) {
+        Log.Warnf("STORAGE CLASS %s in section [%s]: objects in it can't be read until they're restored, so offset recovery will fail on restart for partitions that don't resume from offsetcheckpointpath!", storageClass, section)
+      }
+    }
+    destination = s3Destination
+  case DESTINATION_LOCAL:
+    localRoot, _ := config.GetString("local", "rootpath")
+    if len(localRoot) == 0 {
+      Log.Errorf("destination=local needs rootpath in the [local] section of config file %s", configFilename)
+      os.Exit(1)
+    }
+    localDestination := &LocalDestination{Root: localRoot, TopicRoots: make(map[string]string)}
+    for _, section := range config.GetSections() {
+      if strings.HasPrefix(section, "topic:") && config.HasOption(section, "basedir") {
+        topic := strings.TrimPrefix(section, "topic:")
+        baseDir, _ := config.GetString(section, "basedir")
+        if len(baseDir) == 0 {
+          Log.Errorf("Empty basedir in section [%s] of config file %s", section, configFilename)
+          os.Exit(1)
+        }
+        localDestination.TopicRoots[S3TopicPrefix(&topic)] = baseDir
+      }
+    }
+    destination = localDestination
+  default:
+    Log.Errorf("Invalid destination `%s` in config file %s, must be one of s3 or local", destinationType, configFilename)
+    os.Exit(1)
+  }
+  // dry runs read as usual but write nothing, nor anything that would make a later real run
+  // believe something was written: no checkpoints, watermarks, retry queue or notifications,
+  // and leftover buffers are kept
+  if dryRun {
+    Log.Warnf("DRY RUN: nothing will be written to or deleted from %s, checkpointfile, offsetcheckpointpath, watermarkfile, retryqueuepath, leftoverbuffers and notifications are ignored", destination.Name())
+    destination = &DryRunDestination{Destination: destination}
+    confirmUploads = false
+  }
 
-    fmt.Printf("S3 Put Object: { Bucket: %s, Key: %s, MimeType:%s }\n", s3bucket.Name, s3path, mime.TypeByExtension(filepath.Ext(chunkBuffer.File.Name())))
-    
-    err = s3bucket.Put(s3path, contents, mime.TypeByExtension(filepath.Ext(chunkBuffer.File.Name())), s3.Private, s3.Options{})
+  if len(verifyContinuity) > 0 {
+    verifyTopic, verifyPartition, err := ParseTopicPartition(verifyContinuity)
     if err != nil {
-      panic(err)
+      Log.Errorf("Invalid -verify-continuity: %s", err)
+      os.Exit(1)
+    }
+    problems, err := VerifyContinuity(destination, &verifyTopic, verifyPartition)
+    if err != nil {
+      Log.Errorf("Couldn't verify %s because: %s", verifyContinuity, err)
+      os.Exit(1)
+    }
+    if problems > 0 {
+      os.Exit(2)
     }
+    os.Exit(0)
   }
-  
-  if !keepBufferFiles {
-    if debug {
-      fmt.Printf("Deleting bufferfile: %s\n", chunkBuffer.File.Name())
+
+  if selfTest {
+    selfTestTopic, _ := config.GetString("kafka", "selftesttopic")
+    selfTestPartition, _ := config.GetInt64("kafka", "selftestpartition")
+    selfTestMaxSize, _ := config.GetInt64("kafka", "maxmessagesize")
+    if len(selfTestTopic) == 0 {
+      Log.Errorf("-selftest needs selftesttopic in the [kafka] section of config file %s", configFilename)
+      os.Exit(1)
     }
-    err = os.Remove(chunkBuffer.File.Name())
+    if !SelfTest(hostname, selfTestTopic, selfTestPartition, uint32(selfTestMaxSize), destination) {
+      fmt.Printf("Selftest failed\n")
+      os.Exit(2)
+    }
+    fmt.Printf("Selftest passed\n")
+    os.Exit(0)
+  }
+
+  if len(compactPartition) > 0 {
+    if deterministicKeys {
+      Log.Errorf("-compact can't be used with deterministickeys, their keys have no day to compact")
+      os.Exit(1)
+    }
+    compactTopic, compactPartitionNumber, err := ParseTopicPartition(compactPartition)
+    if err != nil {
+      Log.Errorf("Invalid -compact: %s", err)
+      os.Exit(1)
+    }
+    day := time.Now().AddDate(0, 0, -1)
+    if len(compactDay) > 0 {
+      if day, err = time.Parse("2006-01-02", compactDay); err != nil {
+        Log.Errorf("Invalid -compact-day `%s`, expected YYYY-MM-DD", compactDay)
+        os.Exit(1)
+      }
+    }
+    compactSmallBytes, _ := config.GetInt64("s3", "compactsmallbytes")
+    if compactSmallBytes <= 0 {
+      compactSmallBytes = DEFAULT_COMPACT_SMALL_BYTES
+    }
+    compactMaxBytes, _ := config.GetInt64("s3", "compactmaxbytes")
+    if compactMaxBytes <= 0 {
+      compactMaxBytes = DEFAULT_COMPACT_MAX_BYTES
+    }
+    replaced, err := CompactDay(destination, &compactTopic, compactPartitionNumber, day, compactSmallBytes, compactMaxBytes)
+    Log.Infof("Compacted %d objects of %s on %s", replaced, compactPartition, day.Format("2006-01-02"))
     if err != nil {
-      fmt.Errorf("Error deleting bufferfile %s: %#v", chunkBuffer.File.Name(), err)
+      Log.Errorf("Couldn't finish compacting %s because: %s", compactPartition, err)
+      os.Exit(1)
     }
+    os.Exit(0)
   }
-  
-  return true, nil
-}
 
-func LastS3KeyWithPrefix(bucket *s3.Bucket, prefix *string) (string, error) {
-  narrowedPrefix := *prefix
-  keyMarker := ""
-  
-  // First, do a few checks for shortcuts for checking backwards: focus in on the 14 days. 
-  // Otherwise just loop forward until there aren't any more results
-  currentDay := time.Now()
-  for i := 0; i < S3_REWIND_IN_DAYS_BEFORE_LONG_LOOP; i++ {
-    testPrefix := fmt.Sprintf("%s%s", *prefix, S3DatePrefix(&currentDay))
-    results, err := bucket.List(narrowedPrefix, "", keyMarker, 0)
-    if err != nil && len(results.Contents) > 0 {
-      narrowedPrefix = testPrefix
-      break
+  // keys are named after the local clock, so a host whose NTP failed writes into the wrong
+  // date prefix and can name objects that sort before ones already written
+  if maxClockSkewSeconds, _ := config.GetInt64("s3", "maxclockskewseconds"); maxClockSkewSeconds > 0 && s3bucket != nil {
+    onClockSkew, _ := config.GetString("s3", "onclockskew")
+    switch onClockSkew {
+    case "":
+      onClockSkew = "fail"
+    case "warn", "fail":
+    default:
+      Log.Errorf("Invalid onclockskew `%s` in config file %s, must be one of warn or fail", onClockSkew, configFilename)
+      os.Exit(1)
+    }
+    skew, err := S3ClockSkew(s3bucket)
+    if err != nil {
+      Log.Errorf("Couldn't check the clock against S3 because: %s", err)
+      os.Exit(1)
+    }
+    if skew > time.Duration(maxClockSkewSeconds) * time.Second || -skew > time.Duration(maxClockSkewSeconds) * time.Second {
+      Log.Warnf("CLOCK SKEW: the local clock is %s off S3's, beyond maxclockskewseconds=%d", skew, maxClockSkewSeconds)
+      if onClockSkew == "fail" {
+        Log.Errorf("Refusing to start because onclockskew=fail")
+        os.Exit(1)
+      }
+    } else {
+      Log.Debugf("Local clock is %s off S3's", skew)
     }
-    currentDay = currentDay.Add(-1 * time.Duration(DAY_IN_SECONDS) * time.Second)
   }
-  
-  lastKey := ""
-  moreResults := true
-  for moreResults {
-    results, err := bucket.List(narrowedPrefix, "", keyMarker, 0)
-    if err != nil { return lastKey, err }
-    
-    if len(results.Contents) == 0 { // empty request, return last found lastKey
-      return lastKey, nil
-    }
-    
-    lastKey = results.Contents[len(results.Contents)-1].Key
-    keyMarker = lastKey
-    moreResults = results.IsTruncated
+
+  validateSchemas, _ := config.GetBool("schemaregistry", "validate")
+  if validateSchemas {
+    schemaRegistryUrl, _ := config.GetString("schemaregistry", "url")
+    fixedSchemaId, _ := config.GetInt64("schemaregistry", "schemaid")
+    schemaValidator = NewSchemaRegistry(schemaRegistryUrl, uint32(fixedSchemaId))
   }
-  return lastKey, nil
-}
 
-func main() {
-  flag.Parse()  // Read argv
-  
-  if shouldOutputVersion {
-    fmt.Printf("kafka-s3-consumer %s\n", VERSION)
-    os.Exit(0)
+  notifyUrl, _ := config.GetString("default", "notifyurl")
+  notifySnsArn, _ := config.GetString("default", "notifysnsarn")
+  if dryRun {
+    notifyUrl, notifySnsArn = "", ""
   }
-  
-  config, err := configfile.ReadConfigFile(configFilename)
-  if err != nil {
-    fmt.Printf("Couldn't read config file %s because: %#v\n", configFilename, err)
-    panic(err)
+  if len(notifyUrl) > 0 {
+    notifier = NewWebhookNotifier(notifyUrl)
+  } else if len(notifySnsArn) > 0 {
+    awsAuth, err := AWSAuth(awsKey, awsSecret, useIAMRole)
+    if err != nil {
+      Log.Errorf("Couldn't find AWS credentials for SNS notifications because: %s", err)
+      os.Exit(1)
+    }
+    snsClient, err := sns.New(awsAuth, region)
+    if err != nil {
+      Log.Errorf("Couldn't set up SNS notifications to %s because: %#v", notifySnsArn, err)
+      panic(err)
+    }
+    notifier = &SNSNotifier{TopicArn: notifySnsArn, SNS: snsClient}
+  }
+
+  if failedUploadsFilename, _ := config.GetString("default", "faileduploadsfile"); len(failedUploadsFilename) > 0 {
+    failedUploads = &FailedUploadLog{Path: failedUploadsFilename}
+  }
+  if watermarkFilename, _ := config.GetString("default", "watermarkfile"); len(watermarkFilename) > 0 && !dryRun {
+    watermarks = NewWatermarkFile(watermarkFilename)
+  }
+  healthAddr, _ := config.GetString("default", "healthaddr")
+  if len(healthAddr) > 0 {
+    healthMaxStaleSeconds, _ := config.GetInt64("default", ConfigOptionName(config, "default", "healthmaxstaleseconds", "healthstaleflushseconds"))
+    healthDegradedOK, _ := config.GetBool("default", "healthdegradedok")
+    if !config.HasOption("default", "healthdegradedok") && config.HasOption("default", "healthfailwhendegraded") {
+      Log.Warnf("healthfailwhendegraded in the [default] section is deprecated, set healthdegradedok instead")
+      healthFailWhenDegraded, _ := config.GetBool("default", "healthfailwhendegraded")
+      healthDegradedOK = !healthFailWhenDegraded
+    }
+    health = NewHealthTracker(time.Duration(healthMaxStaleSeconds) * time.Second, healthDegradedOK)
+    http.Handle("/healthz", health)
+    go func() {
+      if err := http.ListenAndServe(healthAddr, nil); err != nil {
+        Log.Warnf("Health endpoint on %s stopped: %s", healthAddr, err)
+      }
+    }()
+  }
+  metricsAddr, _ := config.GetString("default", "metricsaddr")
+  if len(metricsAddr) > 0 {
+    metrics = NewMetrics()
+    http.Handle("/metrics", metrics)
+    if metricsAddr != healthAddr { // otherwise the health endpoint's listener serves it too
+      go func() {
+        if err := http.ListenAndServe(metricsAddr, nil); err != nil {
+          Log.Warnf("Metrics endpoint on %s stopped: %s", metricsAddr, err)
+        }
+      }()
+    }
   }
-  
-  // Read configuration file
-  host, _ := config.GetString("kafka", "host")
-  debug, _ = config.GetBool("default", "debug")
-  bufferMaxSizeInByes, _ := config.GetInt64("default", "maxchunksizebytes")
-  bufferMaxAgeInMinutes, _ := config.GetInt64("default", "maxchunkagemins")
-  port, _ := config.GetString("kafka", "port")
-  hostname := fmt.Sprintf("%s:%s", host, port)
-  awsKey, _ := config.GetString("s3", "accesskey")
-  awsSecret, _ := config.GetString("s3", "secretkey")
-  awsRegion, _ := config.GetString("s3", "region")
-  s3BucketName, _ := config.GetString("s3", "bucket")
-  s3bucket := s3.New(aws.Auth{AccessKey: awsKey, SecretKey: awsSecret}, aws.Regions[awsRegion]).Bucket(s3BucketName)
 
+  drainOnShutdown, _ := config.GetBool("default", "drainonshutdown")
+  drainTimeoutSeconds, _ := config.GetInt64("default", "drainshutdowntimeoutseconds")
+  if drainTimeoutSeconds <= 0 {
+    drainTimeoutSeconds = 30
+  }
+  drainTimeout := time.Duration(drainTimeoutSeconds) * time.Second
+  statsIntervalSeconds, _ := config.GetInt64("default", "statsintervalseconds")
+  uploadWorkers, _ := config.GetInt64("default", "uploadworkers")
   kafkaPollSleepMilliSeconds, _ := config.GetInt64("default", "pollsleepmillis")
   maxSize, _ := config.GetInt64("kafka", "maxmessagesize")
+  maxMessagesPerPartition, _ := config.GetInt64("kafka", "maxmessagespartition")
+  maxMessagesPerSec, _ := config.GetInt64("kafka", "maxmessagespersec")
+  // offsetresetpolicy covers every offset kafka no longer has, ongap and onoutofrange are the
+  // older names for its two startup cases, only read when it isn't set
+  offsetResetPolicy := ConfiguredResetPolicy(config, "offsetresetpolicy")
+  for _, deprecated := range []string{"ongap", "onoutofrange"} {
+    if config.HasOption("kafka", "offsetresetpolicy") && config.HasOption("kafka", deprecated) {
+      Log.Warnf("%s in the [kafka] section is deprecated and ignored, offsetresetpolicy=%s applies", deprecated, offsetResetPolicy)
+    }
+  }
+  onGapOption := ConfigOptionName(config, "kafka", "offsetresetpolicy", "ongap")
+  onGap := ConfiguredResetPolicy(config, onGapOption)
+  onOutOfRangeOption := ConfigOptionName(config, "kafka", "offsetresetpolicy", "onoutofrange")
+  onOutOfRange := ConfiguredResetPolicy(config, onOutOfRangeOption)
+  recoveryScanObjects, _ := config.GetInt64("default", "recoveryscanobjects")
+  if recoveryScanObjects < 1 {
+    recoveryScanObjects = 1
+  }
+  recoveryTailBytes, _ = config.GetInt64("default", "recoverytailbytes")
+  releaseFilename, _ := config.GetString("default", "releasefile")
+  recoveryPrefetch, _ := config.GetInt64("default", "recoveryprefetch")
+  if recoveryPrefetch < 1 {
+    recoveryPrefetch = 1
+  }
   tempfilePath, _ := config.GetString("default", "filebufferpath")
+  retryIntervalSeconds, _ := config.GetInt64("default", "retryintervalseconds")
+  if retryIntervalSeconds <= 0 {
+    retryIntervalSeconds = 60
+  }
   topicsRaw, _ := config.GetString("kafka", "topics")
   topics := strings.Split(topicsRaw, ",")
   for i, _ := range topics { topics[i] = strings.TrimSpace(topics[i]) }
-  partitionsRaw, _ := config.GetString("kafka", "partitions")
-  partitionStrings := strings.Split(partitionsRaw, ",")
-  partitions := make([]int64, len(partitionStrings))
-  for i, _ := range partitionStrings { partitions[i], _ = strconv.ParseInt(strings.TrimSpace(partitionStrings[i]),10,64) }
+  var partitions []int64
+  if config.HasOption("kafka", "partitions") { // paired with topics by position
+    partitionsRaw, _ := config.GetString("kafka", "partitions")
+    partitionStrings := strings.Split(partitionsRaw, ",")
+    partitions = make([]int64, len(partitionStrings))
+    for i, _ := range partitionStrings { partitions[i], _ = strconv.ParseInt(strings.TrimSpace(partitionStrings[i]),10,64) }
+  } else { // or every topic says which of its partitions, topic:<partition> or topic:<first>-<last>
+    topics, partitions, err = ExpandTopicPartitions(topics)
+    if err != nil {
+      Log.Errorf("Invalid topics in config file %s: %s", configFilename, err)
+      os.Exit(1)
+    }
+  }
+  if len(topics) != len(partitions) {
+    Log.Errorf("topics and partitions in config file %s have different lengths, %d and %d", configFilename, len(topics), len(partitions))
+    os.Exit(1)
+  }
 
-  // Fetch Offsets from S3 (look for last written file and guid)
-  if debug {
-    fmt.Printf("Fetching offsets for each topic from s3 bucket %s ...\n", s3bucket.Name)
+  // drop topics paused with `enabled=false` in their [topic:<name>] section
+  enabledTopics := make([]string, 0, len(topics))
+  enabledPartitions := make([]int64, 0, len(partitions))
+  for i, _ := range topics {
+    if section := "topic:" + topics[i]; config.HasOption(section, "enabled") {
+      if enabled, _ := config.GetBool(section, "enabled"); !enabled {
+        Log.Infof("Topic %s is disabled, not consuming partition %d", topics[i], partitions[i])
+        continue
+      }
+    }
+    enabledTopics = append(enabledTopics, topics[i])
+    enabledPartitions = append(enabledPartitions, partitions[i])
+  }
+  topics, partitions = enabledTopics, enabledPartitions
+  for i, _ := range topics {
+    if TopicOutputFormat(topics[i]) == OUTPUT_FORMAT_PARQUET && len(TopicParquetSchema(topics[i])) == 0 {
+      Log.Errorf("Topic %s is written as parquet but has no parquetschema in config file %s", topics[i], configFilename)
+      os.Exit(1)
+    }
+  }
+
+  retryQueuePath, _ := config.GetString("default", "retryqueuepath")
+  if len(retryQueuePath) > 0 && !dryRun {
+    retryQueue, err = OpenRetryQueue(retryQueuePath)
+    if err != nil {
+      Log.Errorf("Couldn't open retry queue %s because: %#v", retryQueuePath, err)
+      panic(err)
+    }
+  }
+
+  if cleanupIncompleteUploads, _ := config.GetBool("s3", "cleanupincompleteuploads"); cleanupIncompleteUploads && s3bucket != nil && !dryRun {
+    incompleteUploadAgeHours, _ := config.GetInt64("s3", "incompleteuploadagehours")
+    if incompleteUploadAgeHours <= 0 {
+      incompleteUploadAgeHours = 24
+    }
+    for i, _ := range topics {
+      prefix := S3TopicPartitionPrefix(&topics[i], partitions[i])
+      for _, uploadsPrefix := range []string{prefix, S3_DEAD_LETTER_PREFIX + prefix} {
+        aborted, err := AbortIncompleteUploads(s3bucket, uploadsPrefix, time.Duration(incompleteUploadAgeHours) * time.Hour)
+        if err != nil {
+          Log.Warnf("Couldn't clean up incomplete uploads under %s because: %s", uploadsPrefix, err)
+        } else {
+          Log.Debugf("Aborted %d incomplete uploads under %s", aborted, uploadsPrefix)
+        }
+      }
+    }
+  }
+
+  leftoverBuffers, _ := config.GetString("default", "leftoverbuffers")
+  switch leftoverBuffers {
+  case "":
+    leftoverBuffers = LEFTOVER_BUFFERS_KEEP
+  case LEFTOVER_BUFFERS_KEEP, LEFTOVER_BUFFERS_UPLOAD, LEFTOVER_BUFFERS_DELETE:
+  default:
+    Log.Errorf("Invalid leftoverbuffers `%s` in config file %s, must be one of keep, upload or delete", leftoverBuffers, configFilename)
+    os.Exit(1)
+  }
+  if dryRun {
+    leftoverBuffers = LEFTOVER_BUFFERS_KEEP
+  }
+  // a checkpoint past the last object is only safe to resume from once the leftover buffer
+  // holding the messages in between has been uploaded
+  if checkpointFilename, _ := config.GetString("default", "checkpointfile"); len(checkpointFilename) > 0 && !dryRun {
+    if leftoverBuffers != LEFTOVER_BUFFERS_UPLOAD {
+      Log.Errorf("checkpointfile needs leftoverbuffers=upload in config file %s", configFilename)
+      os.Exit(1)
+    }
+    checkpointIntervalSeconds, _ = config.GetInt64("default", "checkpointintervalseconds")
+    if checkpointIntervalSeconds <= 0 {
+      checkpointIntervalSeconds = DEFAULT_CHECKPOINT_INTERVAL_SECONDS
+    }
+    var err error
+    if checkpoints, err = LoadCheckpointFile(checkpointFilename); err != nil {
+      Log.Errorf("Couldn't load checkpointfile: %s", err)
+      os.Exit(1)
+    }
   }
+  // a missing or unreadable cache only costs the scan it was meant to save
+  if offsetCheckpointPath, _ := config.GetString("default", "offsetcheckpointpath"); len(offsetCheckpointPath) > 0 && !dryRun {
+    var err error
+    if offsetCache, err = LoadCheckpointFile(offsetCheckpointPath); err != nil {
+      Log.Warnf("Ignoring offsetcheckpointpath, recovering every partition from %s: %s", destination.Name(), err)
+      offsetCache = &CheckpointFile{Path: offsetCheckpointPath, partitions: make(map[string]*PartitionCheckpoint)}
+    }
+  }
+  keptLeftovers := HandleLeftoverBuffers(tempfilePath, leftoverBuffers, streamCompression, destination)
+
+  // Fetch Offsets from S3 (look for last written file and guid)
+  Log.Debugf("Fetching offsets for each topic from %s ...", destination.Name())
   offsets := make([]uint64, len(topics))
+  // 0.7 offsets are where a message starts, so a broker started at the last archived offset
+  // reads that message again, its PartitionBuffer skips it
+  resumesArchived := make([]bool, len(topics))
+  emptyPartitions := 0
+  recoveries := make(chan *S3OffsetRecovery, recoveryPrefetch - 1) // plus the one being fetched
+  go func() { // read ahead, overlapping the next partitions' S3 calls with this one's kafka calls
+    for i, _ := range offsets {
+      if offsetCache != nil {
+        if cachedOffset, found := offsetCache.LastOffset(topics[i], partitions[i]); found {
+          recoveries <- &S3OffsetRecovery{Offset: cachedOffset, Archived: true}
+          continue
+        }
+      }
+      recoveries <- RecoverS3Offset(destination, &topics[i], partitions[i], int(recoveryScanObjects))
+    }
+  }()
   for i, _ := range offsets {
     prefix := S3TopicPartitionPrefix(&topics[i], partitions[i])
-    if debug {
-      fmt.Printf("  Looking at %s object versions: ", prefix)
-    }
-    latestKey, err := LastS3KeyWithPrefix(s3bucket, &prefix)
-    if err != nil { panic(err) }
-
-    if debug {
-      fmt.Printf("Got: %#v\n", latestKey)
-    }
-    
-    if len(latestKey) == 0 { // no keys found, there aren't any files written, so start at 0 offset
-      offsets[i] = 0
-      if debug {
-        fmt.Printf("  No s3 object found, assuming Offset:%d\n", offsets[i])
-      }
-    } else { // if a key was found we have to open the object and find the last offset
-      if debug {
-        fmt.Printf("  Found s3 object %s, got: ", latestKey)
-      }
-      contentBytes, err := s3bucket.Get(latestKey)
-      guidPrefix := KafkaMsgGuidPrefix(&topics[i], partitions[i])
-      lines := strings.Split(string(contentBytes), "\n")
-      for l := len(lines)-1; l >= 0; l-- {
-        if debug {
-          fmt.Printf("    Looking at Line '%s'\n", lines[l])
-        }
-        if strings.HasPrefix(lines[l], guidPrefix) { // found a line with a guid, extract offset and escape out
-          guidSplits := strings.SplitN(strings.SplitN(lines[l], "|", 2)[0], guidPrefix, 2)
-          offsetString := guidSplits[len(guidSplits)-1]
-          offsets[i], err = strconv.ParseUint(offsetString, 10, 64)
-          if err != nil {
-            panic (err)
-          }
-          if debug {
-            fmt.Printf("OffsetString:%s(L#%d), Offset:%d\n", offsetString, l, offsets[i])
-          }
-          break
+    recovery := <-recoveries
+    if recovery.Err != nil { panic(recovery.Err) }
+    offsets[i] = recovery.Offset
+    archived := recovery.Archived
+    if retryQueue != nil {
+      if queuedOffset, found := retryQueue.LastOffset(topics[i], partitions[i]); found && (!archived || queuedOffset > offsets[i]) {
+        Log.Debugf("  Retry queue holds %s up to Offset:%d", prefix, queuedOffset)
+        offsets[i] = queuedOffset
+        archived = true
+      }
+    }
+    if checkpoints != nil && !keptLeftovers[fmt.Sprintf("%s#%d", topics[i], partitions[i])] {
+      if checkpointOffset, found := checkpoints.LastOffset(topics[i], partitions[i]); found && (!archived || checkpointOffset > offsets[i]) {
+        Log.Debugf("  Checkpoint holds %s up to Offset:%d", prefix, checkpointOffset)
+        offsets[i] = checkpointOffset
+        archived = true
+      }
+    }
+    Log.Debugf("  Recovered %s at Offset:%d", prefix, offsets[i])
+    recoveredOffset := offsets[i]
+
+    // Make sure kafka still has the recovered offset, retention may have deleted it since
+    earliest, err := KafkaOffsetBoundary(hostname, &topics[i], partitions[i], KAFKA_OFFSET_EARLIEST)
+    if err != nil {
+      Log.Errorf("Couldn't fetch the earliest offset of %s#%d because: %#v", topics[i], partitions[i], err)
+      panic(err)
+    }
+    latest, err := KafkaOffsetBoundary(hostname, &topics[i], partitions[i], KAFKA_OFFSET_LATEST)
+    if err != nil {
+      Log.Errorf("Couldn't fetch the latest offset of %s#%d because: %#v", topics[i], partitions[i], err)
+      panic(err)
+    }
+    if offsets[i] < earliest {
+      if !archived {
+        offsets[i] = earliest
+      } else {
+        Log.Warnf("OFFSET GAP on %s#%d: resuming at Offset:%d but kafka's earliest available is %d, %d offsets were lost to retention!", topics[i], partitions[i], offsets[i], earliest, earliest - offsets[i])
+        switch onGap {
+        case "earliest":
+          offsets[i] = earliest
+        case "latest":
+          offsets[i] = latest
+        case "fail":
+          Log.Errorf("Refusing to start because %s=fail", onGapOption)
+          os.Exit(1)
         }
+        Log.Warnf("%s=%s, %s#%d will start at Offset:%d", onGapOption, onGap, topics[i], partitions[i], offsets[i])
       }
     }
+
+    // and that it isn't past the end, as after the topic was recreated
+    if offsets[i] > latest {
+      Log.Warnf("OFFSET OUT OF RANGE on %s#%d: resuming at Offset:%d but kafka's latest is %d, was the topic recreated?", topics[i], partitions[i], offsets[i], latest)
+      switch onOutOfRange {
+      case "earliest":
+        offsets[i] = earliest
+      case "latest":
+        offsets[i] = latest
+      case "fail":
+        Log.Errorf("Refusing to start because %s=fail", onOutOfRangeOption)
+        os.Exit(1)
+      }
+      Log.Warnf("%s=%s, %s#%d will start at Offset:%d", onOutOfRangeOption, onOutOfRange, topics[i], partitions[i], offsets[i])
+    }
+
+    resumesArchived[i] = archived && offsets[i] == recoveredOffset
+
+    // Say plainly which case we're in, an empty topic otherwise looks just like a broken recovery
+    if earliest == latest {
+      emptyPartitions++
+      Log.Infof("Partition %s#%d is empty, starting at Offset:%d", topics[i], partitions[i], offsets[i])
+    } else if archived {
+      Log.Infof("Resuming partition %s#%d at Offset:%d (kafka holds %d to %d)", topics[i], partitions[i], offsets[i], earliest, latest)
+    } else {
+      Log.Infof("Nothing archived yet for partition %s#%d, starting at earliest available Offset:%d", topics[i], partitions[i], offsets[i])
+    }
+  }
+  if emptyPartitions > 0 {
+    Log.Infof("%d of %d partitions are empty", emptyPartitions, len(offsets))
   }
 
   
   
-  if debug {
-    fmt.Printf("Making sure chunkbuffer directory structure exists at %s\n", tempfilePath)
+  if retryQueue != nil {
+    if queued := retryQueue.Len(); queued > 0 {
+      Log.Infof("Draining %d bufferfiles left in the retry queue %s before consuming...", queued, retryQueuePath)
+      if remaining := retryQueue.Drain(destination); remaining > 0 {
+        Log.Warnf("%d bufferfiles are still queued, retrying every %d seconds in the background", remaining, retryIntervalSeconds)
+      }
+    }
+    retryQueue.DrainEvery(time.Duration(retryIntervalSeconds) * time.Second, destination)
   }
+
+  Log.Debugf("Making sure chunkbuffer directory structure exists at %s", tempfilePath)
   err = os.MkdirAll(tempfilePath, 0700)
   if err != nil {
-    fmt.Errorf("Error ensuring chunkbuffer directory structure %s: %#v\n", tempfilePath, err)
+    Log.Errorf("Error ensuring chunkbuffer directory structure %s: %#v", tempfilePath, err)
     panic(err)
   }
   
-  if debug {
-    fmt.Printf("Watching %d topics, opening a chunkbuffer for each.\n", len(topics))
-  }
+  Log.Debugf("Watching %d topics, opening a chunkbuffer for each.", len(topics))
   buffers := make([]*ChunkBuffer, len(topics))
   for i, _ := range topics {
+    // a topic's own [topic:<name>] section wins over [default], successors inherit the result
+    topicMaxSizeInBytes, topicMaxAgeInMinutes := bufferMaxSizeInByes, bufferMaxAgeInMinutes
+    topicMinSizeInBytes := bufferMinSizeInBytes
+    if section := "topic:" + topics[i]; config.HasOption(section, "maxchunksizebytes") {
+      topicMaxSizeInBytes, _ = config.GetInt64(section, "maxchunksizebytes")
+    }
+    if section := "topic:" + topics[i]; config.HasOption(section, "maxchunkagemins") {
+      topicMaxAgeInMinutes, _ = config.GetInt64(section, "maxchunkagemins")
+    }
+    if section := "topic:" + topics[i]; config.HasOption(section, "minchunksizebytes") {
+      topicMinSizeInBytes, _ = config.GetInt64(section, "minchunksizebytes")
+    }
     buffers[i] = &ChunkBuffer{FilePath: &tempfilePath, 
-      MaxSizeInBytes: bufferMaxSizeInByes, 
-      MaxAgeInMins: bufferMaxAgeInMinutes, 
+      MaxSizeInBytes: topicMaxSizeInBytes, 
+      MaxAgeInMins: topicMaxAgeInMinutes, 
+      MaxHardAgeInMins: bufferMaxHardAgeInMinutes,
+      MinSizeInBytes: topicMinSizeInBytes,
+      MaxLatencyInSecs: bufferMaxLatencySeconds,
+      MinMessages: bufferMinMessages,
       Topic: &topics[i], 
       Partition: partitions[i],
       Offset: offsets[i],
+      Compression: streamCompression,
+      Format: TopicOutputFormat(topics[i]),
     }
     buffers[i].CreateBufferFileOrPanic()
-    if debug {
-      fmt.Printf("Consumer[%s#%d][chunkbuffer]: %s\n", hostname, i, buffers[i].File.Name())
-    }
+    Log.Debugf("Consumer[%s#%d][chunkbuffer]: %s", hostname, i, buffers[i].File.Name())
   }
   
-  
-  if debug {
-    fmt.Printf("Setting up a broker for each of the %d topics.\n", len(topics))
+  var deadLetterBuffers []*ChunkBuffer
+  if schemaValidator != nil {
+    deadLetterBuffers = make([]*ChunkBuffer, len(topics))
+    for i, _ := range topics {
+      deadLetterBuffers[i] = buffers[i].Successor()
+      deadLetterBuffers[i].DeadLetter = true
+      deadLetterBuffers[i].Format = OUTPUT_FORMAT_LEGACY // the reason needs its own field
+      deadLetterBuffers[i].CreateBufferFileOrPanic()
+    }
   }
+  
+  Log.Debugf("Setting up a broker for each of the %d topics.", len(topics))
   brokers := make([]*kafka.BrokerConsumer, len(topics))
-  for i, _ := range partitionStrings { 
-    fmt.Printf("Setup Consumer[%s#%d]: { topic: %s, partition: %d, offset: %d, maxMessageSize: %d }\n", 
+  for i, _ := range topics { 
+    Log.Infof("Setup Consumer[%s#%d]: { topic: %s, partition: %d, offset: %d, maxMessageSize: %d }", 
       hostname, 
       i,
       topics[i], 
@@ -322,70 +2100,363 @@ func main() {
   }
 
   
-  if debug {
-    fmt.Printf("Brokers created, starting to listen with %d brokers...\n", len(brokers))
+  Log.Debugf("Brokers created, starting to listen with %d brokers...", len(brokers))
+
+
+  partitionStats := make([]*PartitionStats, len(brokers))
+  partitionNames := make([]string, len(brokers))
+  for i, _ := range partitionStats {
+    partitionStats[i] = &PartitionStats{}
+    partitionNames[i] = fmt.Sprintf("%s#%d", topics[i], partitions[i])
+  }
+  if statsIntervalSeconds > 0 {
+    ReportStatsEvery(time.Duration(statsIntervalSeconds) * time.Second, partitionNames, partitionStats)
+  }
+
+  brokerFinishes := make(chan int, len(brokers))
+  brokerPanics := make([]interface{}, len(brokers)) // set before a broker's finish is sent
+  rotateRequests := make([]chan bool, len(brokers)) // from a partition of the same topic, with coordinatedflush
+  for i, _ := range rotateRequests {
+    rotateRequests[i] = make(chan bool, 1)
+  }
+  // every broker stops when ctx is cancelled, quitting (or, with drainonshutdown, draining and
+  // then quitting) through its quitSignals channel, which is what ConsumeUntilQuit listens to.
+  // SIGTERM cancels it too, it's how container runtimes stop us, and every broker flushes its
+  // buffer on the way out
+  ctx, cancel := context.WithCancel(context.Background())
+  shutdownSignal := make(chan os.Signal, 1)
+  signal.Notify(shutdownSignal, os.Interrupt, syscall.SIGTERM)
+  go func() {
+    sig := <-shutdownSignal
+    Log.Infof("Received %s, stopping every broker", sig)
+    cancel()
+  }()
+  quitSignals := make([]chan os.Signal, len(brokers))
+  for i, _ := range quitSignals {
+    quitSignals[i] = make(chan os.Signal, 1)
+  }
+
+  // with uploadworkers, rotated out buffers are uploaded in the background by an uploader per
+  // partition, with at most uploadworkers uploads in flight across all of them.  A partition
+  // whose upload panics is stopped, its final flush panics with it
+  var uploadSlots chan bool
+  if uploadWorkers > 0 {
+    uploadSlots = make(chan bool, uploadWorkers)
+  }
+  partitionBuffers := make([]*PartitionBuffer, len(brokers))
+  for i, _ := range partitionBuffers {
+    var deadLetters *ChunkBuffer
+    if deadLetterBuffers != nil {
+      deadLetters = deadLetterBuffers[i]
+    }
+    partitionBuffers[i] = NewPartitionBuffer(buffers[i], deadLetters, destination, uploadSlots)
+    partitionBuffers[i].ResumesArchived = resumesArchived[i]
+    quitSignal := quitSignals[i]
+    partitionBuffers[i].OnUploadPanic = func() {
+      select {
+      case quitSignal <- os.Interrupt:
+      default: // a quit is already pending
+      }
+    }
+  }
+
+  // On SIGUSR1, flush and stop the brokers of every topic#partition listed in releasefile,
+  // so an externally coordinated instance can take them over without gaps or duplicates
+  if len(releaseFilename) > 0 {
+    releaseSignal := make(chan os.Signal, 1)
+    signal.Notify(releaseSignal, syscall.SIGUSR1)
+    go func() {
+      for _ = range releaseSignal {
+        releaseBytes, err := ioutil.ReadFile(releaseFilename)
+        if err != nil {
+          Log.Warnf("Couldn't read releasefile %s because: %#v", releaseFilename, err)
+          continue
+        }
+        for _, line := range strings.Split(string(releaseBytes), "\n") {
+          release := strings.TrimSpace(line)
+          if len(release) == 0 { continue }
+          matched := false
+          for i, _ := range brokers {
+            if release != fmt.Sprintf("%s#%d", topics[i], partitions[i]) { continue }
+            matched = true
+            select {
+            case quitSignals[i] <- os.Interrupt:
+              Log.Infof("Releasing %s, flushing Broker#%d and stopping it", release, i)
+            default: // already stopping
+            }
+          }
+          if !matched {
+            Log.Warnf("Not releasing %s from releasefile %s, no broker consumes it", release, releaseFilename)
+          }
+        }
+      }
+    }()
   }
 
+  // 0.7 brokers don't track consumer lag, so ask each for its latest offset every so often
+  if metrics != nil {
+    go func() {
+      for _ = range time.Tick(METRICS_LAG_INTERVAL) {
+        for i, _ := range brokers {
+          latest, err := KafkaOffsetBoundary(hostname, &topics[i], partitions[i], KAFKA_OFFSET_LATEST)
+          if err != nil {
+            Log.Debugf("Couldn't fetch the latest offset of %s#%d for offset_lag_bytes: %s", topics[i], partitions[i], err)
+            continue
+          }
+          metrics.SetOffsetLag(topics[i], partitions[i], int64(latest) - int64(partitionBuffers[i].Offset()))
+        }
+      }
+    }()
+  }
 
-	brokerFinishes := make(chan bool, len(brokers))
   for idx, currentBroker := range brokers {
+    if health != nil {
+      health.SetAlive(topics[idx], partitions[idx], true)
+    }
     go func(i int, broker *kafka.BrokerConsumer) {
-      quitSignal := make(chan os.Signal, 1) 
-      signal.Notify(quitSignal, os.Interrupt)
-      consumedCount, skippedCount, err := broker.ConsumeUntilQuit(kafkaPollSleepMilliSeconds, quitSignal, func(msg *kafka.Message){
+      quitSignal := quitSignals[i]
+      partitionBuffer := partitionBuffers[i]
+      partitionLog := PartitionLogger(topics[i], partitions[i])
+      // always report in, so main waits for every broker.  A broker that panics leaves its
+      // buffer file behind for leftoverbuffers, and stops the others so the process exits
+      // instead of running on without it
+      defer func() {
+        if r := recover(); r != nil {
+          brokerPanics[i] = r
+          if health != nil {
+            health.SetAlive(topics[i], partitions[i], false)
+          }
+          partitionLog.Errorf("Broker#%d panicked, stopping the other brokers: %v", i, r)
+          for _, otherQuitSignal := range quitSignals {
+            select {
+            case otherQuitSignal <- os.Interrupt:
+            default: // a quit is already pending
+            }
+          }
+        }
+        brokerFinishes <- i
+      }()
+
+      // with coordinatedflush, a buffer rotated for being due asks the topic's other partitions
+      // to rotate along with it
+      requestRotations := func() {
+        if !coordinatedFlush {
+          return
+        }
+        for j, _ := range rotateRequests {
+          if j != i && topics[j] == topics[i] {
+            select {
+            case rotateRequests[j] <- true:
+            default: // a rotation is already pending
+            }
+          }
+        }
+      }
+
+      // the consume callback only runs when messages arrive, so rotate aged buffers, enforce
+      // the latency guarantee, mirror in-progress buffers and checkpoint from a ticker as well,
+      // otherwise an idle partition never flushes
+      consumerDone := make(chan bool)
+      tickerDone := make(chan bool)
+      go func() {
+        defer close(tickerDone)
+        ticker := time.NewTicker(flushTickInterval)
+        defer ticker.Stop()
+        lastBoundary := time.Now().Truncate(flushBoundary)
+        for {
+          select {
+          case <-consumerDone:
+            return
+          case <-rotateRequests[i]:
+            if partitionBuffer.Rotate() {
+              partitionLog.Debugf("Another partition of `%s` rotated, rotated along with it", topics[i])
+            }
+          case <-ticker.C:
+            boundary := time.Now().Truncate(flushBoundary)
+            if flushBoundary > 0 && boundary.After(lastBoundary) {
+              lastBoundary = boundary
+              if partitionBuffer.Rotate() {
+                partitionLog.Debugf("Crossed a flushboundaryseconds boundary, forced a flush")
+              }
+            } else if partitionBuffer.RotateIfNeeded() {
+              partitionLog.Debugf("Idle or latent buffer was due for rotation, forced a flush")
+              requestRotations()
+            }
+            partitionBuffer.Maintain()
+            // a quiet partition never flushes, nothing to flush is as good as flushed to health
+            if health != nil && partitionBuffer.Idle() {
+              health.Idle(topics[i], partitions[i])
+            }
+          }
+        }
+      }()
+
+      // on shutdown, keep consuming up to the high water mark the partition had at the time.
+      // 0.7 offsets point at the start of a message, so the last one before the mark is never
+      // at it, the partition going quiet for a while means that one's been consumed too
+      var lastMessageAt int64 // UnixNano, written by the callback and read by the drain
+      go func() {
+        select {
+        case <-ctx.Done():
+        case <-consumerDone:
+          return
+        }
+        if drainOnShutdown {
+          highWaterMark, err := KafkaOffsetBoundary(hostname, &topics[i], partitions[i], KAFKA_OFFSET_LATEST)
+          if err != nil {
+            partitionLog.Warnf("Couldn't fetch the high water mark to drain to, stopping now: %s", err)
+          } else {
+            partitionLog.Infof("Draining up to Offset:%d before shutting down", highWaterMark)
+            drainIdle := time.Duration(DRAIN_IDLE_POLLS * kafkaPollSleepMilliSeconds) * time.Millisecond
+            if drainIdle < FLUSH_TICK_INTERVAL {
+              drainIdle = FLUSH_TICK_INTERVAL
+            }
+            for deadline := time.Now().Add(drainTimeout); time.Now().Before(deadline); {
+              time.Sleep(FLUSH_TICK_INTERVAL)
+              idleFor := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&lastMessageAt))
+              if partitionBuffer.Offset() >= highWaterMark || idleFor >= drainIdle {
+                break
+              }
+            }
+          }
+        }
+        select {
+        case quitSignal <- os.Interrupt:
+        default: // a quit is already pending
+        }
+      }()
+
+      var writtenCount int64 = 0
+      registryGaveUp := false
+      var consumeLimit *TokenBucket
+      if maxMessagesPerSec > 0 {
+        consumeLimit = NewTokenBucket(maxMessagesPerSec)
+      }
+      consume := func(msg *kafka.Message){
+        // throttled before taking the lock, so the ticker can still flush while we wait, and
+        // the next fetch waits on this callback, so the brokers see the same rate
+        if msg != nil && consumeLimit != nil {
+          consumeLimit.Wait()
+        }
+        // validated before taking the lock too, waiting out a registry outage can take a while
+        var invalid error
+        if msg != nil && schemaValidator != nil && !registryGaveUp {
+          invalid = schemaValidator.ValidateWhenAvailable(msg.Payload(), ctx.Done())
+        }
+        if msg != nil {
+          atomic.StoreInt64(&lastMessageAt, time.Now().UnixNano())
+        }
+        if msg != nil && partitionBuffer.SkipResumed(msg) {
+          partitionLog.Debugf("Skipping Offset:%d, it was the last message archived before the restart", msg.Offset())
+          return
+        }
+
         if msg != nil {
+          if maxMessagesPerPartition > 0 && writtenCount >= maxMessagesPerPartition {
+            return // cap already reached, drop the rest of the fetch while the quit is handled
+          }
           if debug {
             fmt.Printf("`%s` { ", topics[i])
             msg.Print()
             fmt.Printf("}\n")
           }
-          buffers[i].PutMessage(msg)
+          partitionStats[i].Consumed(len(msg.Payload()))
+          if schemaValidator != nil {
+            // stopping while the registry is down: archive nothing from here on, so a restart
+            // reads this message again rather than skipping it
+            if _, unavailable := invalid.(*SchemaUnavailableError); unavailable && !registryGaveUp {
+              partitionLog.Warnf("Stopping with the schema registry unavailable, Offset:%d and after are left for the next run", msg.Offset())
+              registryGaveUp = true
+            }
+            if registryGaveUp {
+              return
+            }
+            if invalid != nil {
+              partitionLog.Warnf("Dead lettering Offset:%d, %s", msg.Offset(), invalid)
+              partitionBuffer.AppendDeadLetter(msg, invalid.Error())
+              return
+            }
+          }
+          if partitionBuffer.Append(msg) {
+            requestRotations()
+          }
+          writtenCount++
+          if maxMessagesPerPartition > 0 && writtenCount >= maxMessagesPerPartition {
+            partitionLog.Infof("Wrote %d messages, the configured maxmessagespartition, stopping.", writtenCount)
+            select {
+            case quitSignal <- os.Interrupt:
+            default: // a quit is already pending
+            }
+          }
+          return
         }
       
         // check for max size and max age ... if over, rotate
         // to new buffer file and upload the old one.
-        if buffers[i].NeedsRotation()  {
-          rotatedOutBuffer := buffers[i]
-
-          if debug {
-            fmt.Printf("Broker#%d: Log Rotation needed! Rotating out of %s\n", i, rotatedOutBuffer.File.Name())
-          }
-          
-          buffers[i] = &ChunkBuffer{FilePath: &tempfilePath, 
-            MaxSizeInBytes: bufferMaxSizeInByes, 
-            MaxAgeInMins: bufferMaxAgeInMinutes, 
-            Topic: &topics[i], 
-            Partition: partitions[i],
-            Offset: msg.Offset(),
-          }
-          buffers[i].CreateBufferFileOrPanic()
-
-          if debug {
-            fmt.Printf("Broker#%d: Rotating into %s\n", i, buffers[i].File.Name())
-          }
-
-          rotatedOutBuffer.StoreToS3AndRelease(s3bucket)
+        if partitionBuffer.RotateIfNeeded() {
+          requestRotations()
+        }
+      }
+      consumedCount, skippedCount, err := broker.ConsumeUntilQuit(kafkaPollSleepMilliSeconds, quitSignal, consume)
+      // retention can delete the offset we're at while we lag behind it, restart from the
+      // boundary offsetresetpolicy names rather than take the partition down
+      for IsOffsetOutOfRange(err) && offsetResetPolicy != "fail" {
+        boundary := int64(KAFKA_OFFSET_EARLIEST)
+        if offsetResetPolicy == "latest" {
+          boundary = KAFKA_OFFSET_LATEST
+        }
+        resetOffset, boundaryErr := KafkaOffsetBoundary(hostname, &topics[i], partitions[i], boundary)
+        if boundaryErr != nil {
+          partitionLog.Errorf("Couldn't fetch the offset to reset to: %s", boundaryErr)
+          break
         }
-      })
+        lostAfter := partitionBuffer.Offset()
+        partitionLog.Warnf("OFFSET OUT OF RANGE after Offset:%d, offsetresetpolicy=%s restarts the broker at Offset:%d, skipping whatever was in between!", lostAfter, offsetResetPolicy, resetOffset)
+        broker = kafka.NewBrokerConsumer(hostname, topics[i], int(partitions[i]), resetOffset, uint32(maxSize))
+        var moreConsumed, moreSkipped int64
+        moreConsumed, moreSkipped, err = broker.ConsumeUntilQuit(kafkaPollSleepMilliSeconds, quitSignal, consume)
+        consumedCount += moreConsumed
+        skippedCount += moreSkipped
+      }
+      close(consumerDone)
+      <-tickerDone // so nothing rotates after the final flush
+      if health != nil {
+        health.SetAlive(topics[i], partitions[i], false)
+      }
+      if metrics != nil {
+        metrics.Skipped(topics[i], partitions[i], skippedCount)
+      }
       
       if err != nil {
-        fmt.Printf("ERROR in Broker#%d:\n", i)
+        partitionLog.Errorf("Broker#%d stopped consuming: %s", i, err)
         panic(err)
       }
 
-      if debug {
-        fmt.Printf("Quit signal handled by Broker Consumer #%d (Topic `%s`)\n", i, topics[i])
-        fmt.Printf("%s Report:  %d messages successfully consumed, %d messages skipped (typically corrupted, check logs)\n", topics[i], consumedCount, skippedCount)
-      }
+      partitionLog.Debugf("Quit signal handled by Broker#%d", i)
+      partitionLog.Debugf("Report:  %d messages successfully consumed, %d messages skipped (typically corrupted, check logs)", consumedCount, skippedCount)
       
-      // buffer stopped, let's clean up nicely
-      buffers[i].StoreToS3AndRelease(s3bucket)
-    
-      brokerFinishes <- true
+      // buffer stopped, let's clean up nicely, after whatever is still queued for upload
+      partitionBuffer.Flush()
     }(idx, currentBroker)
   }
   
-  <- brokerFinishes
+  abnormal := 0
+  for finished := 0; finished < len(brokers); finished++ {
+    i := <- brokerFinishes
+    if brokerPanics[i] != nil {
+      Log.Errorf("Broker#%d (%s) finished abnormally: %v", i, partitionNames[i], brokerPanics[i])
+      abnormal++
+    } else {
+      Log.Debugf("Broker#%d (%s) finished normally", i, partitionNames[i])
+    }
+  }
 
-  fmt.Printf("All %d brokers finished.\n", len(brokers))
+  Log.Debugf("Waiting for outstanding flush notifications...")
+  pendingNotifications.Wait()
+
+  if abnormal > 0 {
+    Log.Errorf("All %d brokers finished, %d abnormally.", len(brokers), abnormal)
+    os.Exit(1)
+  }
+  Log.Infof("All %d brokers finished.", len(brokers))
 }
\ No newline at end of file
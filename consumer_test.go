@@ -0,0 +1,370 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "bytes"
+  "crypto/md5"
+  "encoding/binary"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/crowdmob/kafka"
+)
+
+func fixedClock(t time.Time) func() {
+  previous := now
+  now = func() time.Time { return t }
+  return func() { now = previous }
+}
+
+// newTestChunkBuffer is a buffer with its file created under a temp dir, that rotates at
+// 512 bytes or an hour.
+func newTestChunkBuffer(t *testing.T, topic *string, partition int64) *ChunkBuffer {
+  bufferPath := t.TempDir()
+  buffer := &ChunkBuffer{
+    FilePath: &bufferPath,
+    MaxAgeInMins: 60,
+    MaxSizeInBytes: 512,
+    Topic: topic,
+    Partition: partition,
+  }
+  buffer.CreateBufferFileOrPanic()
+  return buffer
+}
+
+// corruptingDestination is a LocalDestination whose first corruptStores stores flip a byte of
+// what they're given, and which reports the stored file's MD5 the way S3 reports an ETag.
+type corruptingDestination struct {
+  *LocalDestination
+  corruptStores int
+  stores        int
+}
+
+func (destination *corruptingDestination) Store(key string, r io.Reader, size int64, contentType string, meta map[string][]string) error {
+  destination.stores++
+  if destination.stores > destination.corruptStores {
+    return destination.LocalDestination.Store(key, r, size, contentType, meta)
+  }
+  contents, err := ioutil.ReadAll(r)
+  if err != nil {
+    return err
+  }
+  contents[len(contents) / 2] ^= 0xff
+  return destination.LocalDestination.Store(key, bytes.NewReader(contents), size, contentType, meta)
+}
+
+func (destination *corruptingDestination) Stat(key string) (int64, string, error) {
+  contents, err := destination.Get(key)
+  if err != nil {
+    return 0, "", err
+  }
+  sum := md5.Sum(contents)
+  return int64(len(contents)), hex.EncodeToString(sum[:]), nil
+}
+
+// withConfirmedUploads turns on confirmuploads with retries that don't wait, until the
+// returned func puts them back.
+func withConfirmedUploads() func() {
+  previousConfirmUploads, previousMaxBackoff := confirmUploads, s3RetryMaxBackoff
+  confirmUploads, s3RetryMaxBackoff = true, time.Millisecond
+  return func() { confirmUploads, s3RetryMaxBackoff = previousConfirmUploads, previousMaxBackoff }
+}
+
+func TestStoreToS3AndReleaseRetriesCorruptedUpload(t *testing.T) {
+  defer withConfirmedUploads()()
+  destination := &corruptingDestination{LocalDestination: &LocalDestination{Root: t.TempDir()}, corruptStores: 1}
+  topic := "clicks"
+  buffer := newTestChunkBuffer(t, &topic, 3)
+  for n := 0; n < 5; n++ {
+    buffer.PutMessage(kafka.NewMessage([]byte(fmt.Sprintf("m%d", n))))
+  }
+  buffer.closeBufferFile()
+  written, err := ioutil.ReadFile(buffer.File.Name())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if _, err = buffer.StoreToS3AndRelease(destination); err != nil {
+    t.Fatalf("StoreToS3AndRelease: %s", err)
+  }
+  if destination.stores != 2 {
+    t.Errorf("stored %d times, want the corrupted upload retried once", destination.stores)
+  }
+  listing, err := destination.List(S3TopicPartitionPrefix(&topic, 3), "")
+  if err != nil || len(listing.Contents) != 1 {
+    t.Fatalf("List = %v, %v, want the one object", listing, err)
+  }
+  stored, err := destination.Get(listing.Contents[0].Key)
+  if err != nil || !bytes.Equal(stored, written) {
+    t.Errorf("stored %q, %v, want %q", stored, err, written)
+  }
+  if _, err = os.Stat(buffer.File.Name()); !os.IsNotExist(err) {
+    t.Errorf("buffer file is still there after the upload was confirmed: %v", err)
+  }
+}
+
+func TestStoreToS3AndReleaseKeepsBufferWhenEveryUploadIsCorrupted(t *testing.T) {
+  defer withConfirmedUploads()()
+  destination := &corruptingDestination{LocalDestination: &LocalDestination{Root: t.TempDir()}, corruptStores: S3_PUT_ATTEMPTS}
+  topic := "clicks"
+  buffer := newTestChunkBuffer(t, &topic, 3)
+  buffer.PutMessage(kafka.NewMessage([]byte("m0")))
+
+  defer func() {
+    r := recover()
+    if r == nil || !strings.Contains(fmt.Sprint(r), "MD5 mismatch") {
+      t.Errorf("StoreToS3AndRelease panicked with %v, want the MD5 mismatch", r)
+    }
+    if destination.stores != S3_PUT_ATTEMPTS {
+      t.Errorf("stored %d times, want all %d attempts", destination.stores, S3_PUT_ATTEMPTS)
+    }
+    if _, err := os.Stat(buffer.File.Name()); err != nil {
+      t.Errorf("buffer file is gone after every upload was corrupted: %s", err)
+    }
+  }()
+  buffer.StoreToS3AndRelease(destination)
+}
+
+// listingDestination is a LocalDestination that records the prefix of every List.
+type listingDestination struct {
+  *LocalDestination
+  listed []string
+}
+
+func (destination *listingDestination) List(prefix string, marker string) (*DestinationListing, error) {
+  destination.listed = append(destination.listed, prefix)
+  return destination.LocalDestination.List(prefix, marker)
+}
+
+// seedDays stores an object, and its index sidecar, under prefix for each of the given days
+// ago, returning their keys oldest first.
+func seedDays(t *testing.T, destination Destination, prefix string, daysAgo ...int) []string {
+  keys := make([]string, 0, len(daysAgo))
+  for _, ago := range daysAgo {
+    day := time.Now().UTC().AddDate(0, 0, -ago)
+    key := fmt.Sprintf("%s%s%d-host", prefix, S3DatePrefix(&day), day.UnixNano())
+    for _, seeded := range []string{key, key + S3_INDEX_SUFFIX} {
+      if err := destination.Store(seeded, strings.NewReader("x"), 1, "text/plain", nil); err != nil {
+        t.Fatal(err)
+      }
+    }
+    keys = append(keys, key)
+  }
+  return keys
+}
+
+func TestLastS3KeysWithPrefixRewindsByDay(t *testing.T) {
+  destination := &listingDestination{LocalDestination: &LocalDestination{Root: t.TempDir()}}
+  prefix := "clicks/p0/"
+  keys := seedDays(t, destination, prefix, 40, 5, 3, 1)
+
+  last, err := LastS3KeysWithPrefix(destination, &prefix, 1)
+  if err != nil || len(last) != 1 || last[0] != keys[3] {
+    t.Errorf("LastS3KeysWithPrefix(1) = %v, %v, want [%s]", last, err, keys[3])
+  }
+  last, err = LastS3KeysWithPrefix(destination, &prefix, 3)
+  if err != nil || len(last) != 3 || last[0] != keys[3] || last[1] != keys[2] || last[2] != keys[1] {
+    t.Errorf("LastS3KeysWithPrefix(3) = %v, %v, want [%s %s %s]", last, err, keys[3], keys[2], keys[1])
+  }
+  for _, listed := range destination.listed {
+    if listed == prefix {
+      t.Errorf("listed the whole of %s, the last 14 days should have been enough", prefix)
+    }
+  }
+}
+
+func TestLastS3KeysWithPrefixFallsBackToListingEverything(t *testing.T) {
+  destination := &LocalDestination{Root: t.TempDir()}
+  prefix := "clicks/p0/"
+  keys := seedDays(t, destination, prefix, 60, 30)
+  seedDays(t, destination, "clicks/p1/", 1)
+
+  last, err := LastS3KeysWithPrefix(destination, &prefix, 1)
+  if err != nil || len(last) != 1 || last[0] != keys[1] {
+    t.Errorf("LastS3KeysWithPrefix = %v, %v, want [%s]", last, err, keys[1])
+  }
+
+  empty := "clicks/p2/"
+  if last, err = LastS3KeysWithPrefix(destination, &empty, 1); err != nil || len(last) != 0 {
+    t.Errorf("LastS3KeysWithPrefix of an empty partition = %v, %v, want nothing", last, err)
+  }
+}
+
+func TestS3DatePrefix(t *testing.T) {
+  eastern := time.FixedZone("EST", -5 * 60 * 60)
+  for _, c := range []struct {
+    at       time.Time
+    expected string
+  }{
+    {time.Date(2014, 3, 5, 12, 0, 0, 0, time.UTC), "2014/03/05/"},
+    {time.Date(2014, 10, 25, 0, 0, 0, 0, time.UTC), "2014/10/25/"},
+    {time.Date(2014, 12, 31, 23, 59, 59, 999999999, time.UTC), "2014/12/31/"},
+    {time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), "2015/01/01/"},
+    {time.Date(2014, 12, 31, 19, 30, 0, 0, eastern), "2015/01/01/"}, // already the new year in UTC
+  } {
+    if prefix := S3DatePrefix(&c.at); prefix != c.expected {
+      t.Errorf("S3DatePrefix(%s) = %s, want %s", c.at, prefix, c.expected)
+    }
+  }
+}
+
+// keys sort by date only if their prefixes do, September before October included
+func TestS3DatePrefixSortsByDate(t *testing.T) {
+  day := time.Date(2014, 9, 28, 0, 0, 0, 0, time.UTC)
+  previous := S3DatePrefix(&day)
+  for i := 0; i < 100; i++ {
+    day = day.AddDate(0, 0, 1)
+    prefix := S3DatePrefix(&day)
+    if prefix <= previous {
+      t.Fatalf("S3DatePrefix(%s) = %s sorts before the day before's %s", day, prefix, previous)
+    }
+    previous = prefix
+  }
+}
+
+func TestS3TimePrefixByHour(t *testing.T) {
+  previousGranularity := pathGranularity
+  pathGranularity = PATH_GRANULARITY_HOUR
+  defer func() { pathGranularity = previousGranularity }()
+
+  at := time.Date(2014, 12, 31, 22, 5, 0, 0, time.FixedZone("EST", -5 * 60 * 60))
+  if prefix := S3TimePrefix(&at); prefix != "2015/01/01/03/" {
+    t.Errorf("S3TimePrefix(%s) = %s, want 2015/01/01/03/", at, prefix)
+  }
+}
+
+// withIngestTimestamps turns ingesttimestamps on, without checksums, with the compact or text
+// record header, until the returned func puts them back.
+func withIngestTimestamps(compact bool) func() {
+  previousIngest, previousCompact, previousChecksum := ingestTimestamps, compactRecordHeader, recordChecksum
+  ingestTimestamps, compactRecordHeader, recordChecksum = true, compact, false
+  return func() { ingestTimestamps, compactRecordHeader, recordChecksum = previousIngest, previousCompact, previousChecksum }
+}
+
+// storeObjects stores each of contents as an object under prefix and today, oldest first.
+func storeObjects(t *testing.T, destination Destination, prefix string, contents ...string) {
+  today := time.Now().UTC()
+  for n, content := range contents {
+    key := fmt.Sprintf("%s%s%d-host", prefix, S3DatePrefix(&today), today.UnixNano() + int64(n))
+    if err := destination.Store(key, strings.NewReader(content), int64(len(content)), "text/plain", nil); err != nil {
+      t.Fatal(err)
+    }
+  }
+}
+
+func TestRecoverS3OffsetFailsWhenNoObjectHoldsAnOffset(t *testing.T) {
+  destination := &LocalDestination{Root: t.TempDir()}
+  topic := "clicks"
+  storeObjects(t, destination, S3TopicPartitionPrefix(&topic, 0), "garbage\n", "t_views-p_0-o_7|wrong partition\n", "t_clicks-p_0-o_|no offset\n")
+
+  recovery := RecoverS3Offset(destination, &topic, 0, 3)
+  if recovery.Err == nil || recovery.Archived || recovery.Offset != 0 {
+    t.Errorf("RecoverS3Offset = %+v, want an error rather than resuming archived at 0", recovery)
+  }
+}
+
+func TestRecoverS3OffsetLooksFurtherBack(t *testing.T) {
+  destination := &LocalDestination{Root: t.TempDir()}
+  topic := "clicks"
+  storeObjects(t, destination, S3TopicPartitionPrefix(&topic, 0), "t_clicks-p_0-o_41|a\nt_clicks-p_0-o_42|b\n", "garbage\n", "garbage\n")
+
+  recovery := RecoverS3Offset(destination, &topic, 0, 1)
+  if recovery.Err != nil || !recovery.Archived || recovery.Offset != 42 {
+    t.Errorf("RecoverS3Offset = %+v, want Offset:42 from the older object", recovery)
+  }
+}
+
+// withRecordLayout writes records framed by framing with the compact or text header, until the
+// returned func puts them back.
+func withRecordLayout(framing RecordFraming, compact bool) func() {
+  previousFraming, previousCompact := recordFraming, compactRecordHeader
+  recordFraming, compactRecordHeader = framing, compact
+  return func() { recordFraming, compactRecordHeader = previousFraming, previousCompact }
+}
+
+// Objects are read back in the framing and header they were stored with, whatever is configured
+// when offsets are recovered, and objects stored before that was recorded are newline framed.
+func TestRecoverS3OffsetAcrossFramingSwitch(t *testing.T) {
+  destination := &LocalDestination{Root: t.TempDir()}
+  topic := "clicks"
+  storeObjects(t, destination, S3TopicPartitionPrefix(&topic, 0), "t_clicks-p_0-o_41|a\nt_clicks-p_0-o_42|b\n")
+
+  defer withRecordLayout(VarintPrefixedFraming{}, true)()
+  if recovery := RecoverS3Offset(destination, &topic, 0, 1); recovery.Err != nil || recovery.Offset != 42 {
+    t.Fatalf("after switching to varint, RecoverS3Offset = %+v, want Offset:42 from the newline object", recovery)
+  }
+  partitionBuffer := newTestPartitionBuffer(t, &topic, 0, destination, nil)
+  for offset := uint64(43); offset <= 45; offset++ {
+    partitionBuffer.Append(&testMessage{offset, []byte(fmt.Sprintf("m%d", offset))})
+  }
+  partitionBuffer.Flush()
+
+  for _, c := range []struct {
+    framing RecordFraming
+    compact bool
+  }{
+    {VarintPrefixedFraming{}, true},
+    {NewlineFraming{}, false},
+    {LengthPrefixedFraming{}, false},
+  } {
+    recordFraming, compactRecordHeader = c.framing, c.compact
+    recovery := RecoverS3Offset(destination, &topic, 0, 1)
+    if recovery.Err != nil || !recovery.Archived || recovery.Offset != 45 {
+      t.Errorf("framing=%s compact=%v RecoverS3Offset = %+v, want Offset:45 from the varint object", FramingName(c.framing), c.compact, recovery)
+    }
+  }
+}
+
+func TestRecordHeaderIngestTimestamp(t *testing.T) {
+  ingestedAt := time.Date(2026, 3, 4, 5, 6, 7, 8000000, time.UTC)
+  defer fixedClock(ingestedAt)()
+  defer withIngestTimestamps(false)()
+
+  topic := "clicks"
+  header := string(RecordHeader(&topic, 3, 42, []byte("payload")))
+  expected := fmt.Sprintf("t_clicks-p_3-o_42|%d|", ingestedAt.UnixNano() / int64(time.Millisecond))
+  if header != expected {
+    t.Errorf("RecordHeader = %q, want %q", header, expected)
+  }
+}
+
+func TestCompactRecordHeaderIngestTimestamp(t *testing.T) {
+  ingestedAt := time.Date(2026, 3, 4, 5, 6, 7, 8000000, time.UTC)
+  defer fixedClock(ingestedAt)()
+  defer withIngestTimestamps(true)()
+
+  header := CompactRecordHeader(42, []byte("payload"))
+  if offset, ok := ParseCompactOffset(string(header)); !ok || offset != 42 {
+    t.Fatalf("ParseCompactOffset = %d, %v, want 42, true", offset, ok)
+  }
+  _, n := binary.Uvarint(header[1:])
+  ingestMillis, m := binary.Uvarint(header[1 + n:])
+  if m <= 0 || int64(ingestMillis) != ingestedAt.UnixNano() / int64(time.Millisecond) {
+    t.Errorf("ingest time = %d, want %d", ingestMillis, ingestedAt.UnixNano() / int64(time.Millisecond))
+  }
+  if 1 + n + m != len(header) {
+    t.Errorf("header is %d bytes, want %d", len(header), 1 + n + m)
+  }
+}
+
+func TestJSONRecordIngestTimestamp(t *testing.T) {
+  ingestedAt := time.Date(2026, 3, 4, 5, 6, 7, 8000000, time.UTC)
+  defer fixedClock(ingestedAt)()
+  defer withIngestTimestamps(false)()
+
+  topic := "clicks"
+  line := string(EncodeRecord(OUTPUT_FORMAT_JSONL, &topic, 3, 42, []byte("payload"))[0])
+  expected := fmt.Sprintf(`{"topic":"clicks","partition":3,"offset":42,"ingest_ts":%d,"payload":"payload"}`, ingestedAt.UnixNano() / int64(time.Millisecond))
+  if line != expected {
+    t.Errorf("EncodeRecord = %s, want %s", line, expected)
+  }
+}
@@ -0,0 +1,431 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "crypto/md5"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+
+  "github.com/crowdmob/goamz/s3"
+)
+
+const (
+  DESTINATION_S3 = "s3"
+  DESTINATION_LOCAL = "local"
+  DESTINATION_LIST_MAX_KEYS = 1000
+  LOCAL_TEMP_PREFIX = ".tmp-"
+  LOCAL_META_PREFIX = ".meta-"
+  S3_META_HEADER_PREFIX = "x-amz-meta-"
+  SSE_NONE = "none"
+  SSE_AES256 = "AES256"
+  SSE_KMS = "aws:kms"
+)
+
+// Storage classes S3 accepts in x-amz-storage-class.  Objects in the last two have to be
+// restored before they can be read.
+var storageClasses = []string{"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE"}
+
+func ValidStorageClass(storageClass string) bool {
+  for _, valid := range storageClasses {
+    if storageClass == valid {
+      return true
+    }
+  }
+  return false
+}
+
+func ReadableStorageClass(storageClass string) bool {
+  return storageClass != "GLACIER" && storageClass != "DEEP_ARCHIVE"
+}
+
+// Destination is where buffers are stored and where offset recovery reads them back from.
+// Keys are slash separated and list in byte order, the way S3 lists them, which is what
+// offset recovery relies on to find the latest objects.
+type Destination interface {
+  Name() string
+  Store(key string, r io.Reader, size int64, contentType string, meta map[string][]string) error
+  Get(key string) ([]byte, error)
+  // GetTail reads the last tailBytes of an object, whole is true when that's all of it.
+  GetTail(key string, tailBytes int64) (contents []byte, whole bool, err error)
+  // Stat returns an object's size and its MD5 in hex, or "" when the destination can't tell.
+  Stat(key string) (size int64, md5 string, err error)
+  // Metadata returns the meta an object was stored with, nil when it was stored without any.
+  Metadata(key string) (map[string][]string, error)
+  Exists(key string) (bool, error)
+  Delete(key string) error
+  // List returns keys under prefix after marker, at most DESTINATION_LIST_MAX_KEYS of them.
+  List(prefix string, marker string) (*DestinationListing, error)
+}
+
+type DestinationKey struct {
+  Key  string
+  Size int64
+}
+
+type DestinationListing struct {
+  Contents    []DestinationKey
+  IsTruncated bool
+}
+
+// S3Destination writes to a bucket, encrypting every object server side with SSE (one of the
+// SSE_* constants, "" for none) and, for SSE_KMS, SSEKMSKeyId.  Objects are stored in
+// StorageClass, or TopicStorageClasses[S3TopicPrefix(topic)] under a topic's prefix.
+type S3Destination struct {
+  Bucket              *s3.Bucket
+  SSE                 string
+  SSEKMSKeyId         string
+  StorageClass        string
+  TopicStorageClasses map[string]string
+}
+
+func (destination *S3Destination) Name() string {
+  return destination.Bucket.Name
+}
+
+// Store sends the contents' MD5 as Content-MD5 when r can be read twice (buffers and files can),
+// so S3 rejects an upload that was corrupted or cut short on the way rather than storing it.
+func (destination *S3Destination) Store(key string, r io.Reader, size int64, contentType string, meta map[string][]string) error {
+  options := destination.PutOptions(meta)
+  options.StorageClass = s3.StorageClass(destination.KeyStorageClass(key))
+  if seeker, ok := r.(io.ReadSeeker); ok {
+    hash := md5.New()
+    if _, err := io.Copy(hash, seeker); err != nil {
+      return err
+    }
+    if _, err := seeker.Seek(0, 0); err != nil {
+      return err
+    }
+    options.ContentMD5 = base64.StdEncoding.EncodeToString(hash.Sum(nil))
+  }
+  return destination.Bucket.PutReader(key, r, size, contentType, s3.Private, options)
+}
+
+// KeyStorageClass is the storage class of key, "" for the bucket's default.  Sidecars and
+// in-progress objects stay in the default, offset recovery reads the one and the other is
+// overwritten every few seconds.  topicprefixes can nest one topic's prefix in another's, so
+// the longest prefix wins.
+func (destination *S3Destination) KeyStorageClass(key string) string {
+  if IsSidecarKey(key) || strings.HasPrefix(key, S3_IN_PROGRESS_PREFIX) {
+    return ""
+  }
+  storageClass, matched := destination.StorageClass, ""
+  for prefix, topicStorageClass := range destination.TopicStorageClasses {
+    if strings.HasPrefix(key, prefix) && len(prefix) > len(matched) {
+      storageClass, matched = topicStorageClass, prefix
+    }
+  }
+  return storageClass
+}
+
+func (destination *S3Destination) PutOptions(meta map[string][]string) s3.Options {
+  options := s3.Options{Meta: meta}
+  switch destination.SSE {
+  case SSE_AES256:
+    options.SSE = true
+  case SSE_KMS:
+    options.SSEKMS = true
+    options.SSEKMSKeyId = destination.SSEKMSKeyId
+  }
+  return options
+}
+
+func (destination *S3Destination) Get(key string) ([]byte, error) {
+  return destination.Bucket.Get(key)
+}
+
+func (destination *S3Destination) GetTail(key string, tailBytes int64) ([]byte, bool, error) {
+  resp, err := destination.Bucket.GetResponseWithHeaders(key, map[string][]string{"Range": {fmt.Sprintf("bytes=-%d", tailBytes)}})
+  if err != nil {
+    return nil, false, err
+  }
+  defer resp.Body.Close()
+  contents, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return nil, false, err
+  }
+  return contents, int64(len(contents)) < tailBytes || resp.StatusCode == http.StatusOK, nil
+}
+
+// Stat HEADs the object, its ETag is only its MD5 when it's 32 hex digits (multipart ETags
+// aren't) and the object isn't SSE-KMS encrypted (those ETags are 32 hex digits, but not the MD5).
+func (destination *S3Destination) Stat(key string) (int64, string, error) {
+  resp, err := destination.Bucket.Head(key, nil)
+  if err != nil {
+    return 0, "", err
+  }
+  resp.Body.Close()
+  etag := strings.Trim(resp.Header.Get("ETag"), "\"")
+  if len(etag) != 32 || destination.SSE == SSE_KMS || resp.Header.Get("x-amz-server-side-encryption") == SSE_KMS {
+    etag = ""
+  }
+  return resp.ContentLength, etag, nil
+}
+
+// Metadata HEADs the object for its x-amz-meta-* headers.
+func (destination *S3Destination) Metadata(key string) (map[string][]string, error) {
+  resp, err := destination.Bucket.Head(key, nil)
+  if err != nil {
+    return nil, err
+  }
+  resp.Body.Close()
+  var meta map[string][]string
+  for header, values := range resp.Header {
+    if name := strings.ToLower(header); strings.HasPrefix(name, S3_META_HEADER_PREFIX) {
+      if meta == nil {
+        meta = make(map[string][]string)
+      }
+      meta[strings.TrimPrefix(name, S3_META_HEADER_PREFIX)] = values
+    }
+  }
+  return meta, nil
+}
+
+func (destination *S3Destination) Exists(key string) (bool, error) {
+  return destination.Bucket.Exists(key)
+}
+
+func (destination *S3Destination) Delete(key string) error {
+  return destination.Bucket.Del(key)
+}
+
+func (destination *S3Destination) List(prefix string, marker string) (*DestinationListing, error) {
+  results, err := destination.Bucket.List(prefix, "", marker, DESTINATION_LIST_MAX_KEYS)
+  if err != nil {
+    return nil, err
+  }
+  listing := &DestinationListing{Contents: make([]DestinationKey, len(results.Contents)), IsTruncated: results.IsTruncated}
+  for k, key := range results.Contents {
+    listing.Contents[k] = DestinationKey{Key: key.Key, Size: key.Size}
+  }
+  return listing, nil
+}
+
+// DryRunDestination wraps another destination for -dry-run.  Reads go through, so offset
+// recovery runs as it would, but writes and deletes are only logged, and since nothing is ever
+// written nothing exists, so onkeyexists never renames or skips on its account.
+type DryRunDestination struct {
+  Destination
+}
+
+func (destination *DryRunDestination) Store(key string, r io.Reader, size int64, contentType string, meta map[string][]string) error {
+  Log.Infof("Dry run, not storing: { Destination: %s, Key: %s, Size: %d, MimeType:%s }", destination.Name(), key, size, contentType)
+  return nil
+}
+
+func (destination *DryRunDestination) Exists(key string) (bool, error) {
+  return false, nil
+}
+
+func (destination *DryRunDestination) Delete(key string) error {
+  Log.Infof("Dry run, not deleting: { Destination: %s, Key: %s }", destination.Name(), key)
+  return nil
+}
+
+// LocalDestination writes objects as files under Root, for testing without a bucket.  Files
+// are written to a temp file and renamed into place, so a listed file is always complete.
+// Metadata is kept as JSON in a hidden file beside the object's, written before it.  Keys under
+// a topic's prefix are written under TopicRoots[S3TopicPrefix(topic)] rather than Root, when
+// it's set, so topics can land on different mounts.
+type LocalDestination struct {
+  Root       string
+  TopicRoots map[string]string
+}
+
+// KeyRoot is the directory key is written under.  Like topic storage classes, the longest
+// topic prefix wins.
+func (destination *LocalDestination) KeyRoot(key string) string {
+  root, matched := destination.Root, ""
+  for prefix, topicRoot := range destination.TopicRoots {
+    if strings.HasPrefix(key, prefix) && len(prefix) > len(matched) {
+      root, matched = topicRoot, prefix
+    }
+  }
+  return root
+}
+
+func (destination *LocalDestination) path(key string) string {
+  return filepath.Join(destination.KeyRoot(key), filepath.FromSlash(key))
+}
+
+func (destination *LocalDestination) metaPath(key string) string {
+  path := destination.path(key)
+  return filepath.Join(filepath.Dir(path), LOCAL_META_PREFIX + filepath.Base(path))
+}
+
+func (destination *LocalDestination) Name() string {
+  return destination.Root
+}
+
+func (destination *LocalDestination) Store(key string, r io.Reader, size int64, contentType string, meta map[string][]string) error {
+  path := destination.path(key)
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+    return err
+  }
+  if err := destination.storeMetadata(key, meta); err != nil {
+    return err
+  }
+  tmpfile, err := ioutil.TempFile(filepath.Dir(path), LOCAL_TEMP_PREFIX)
+  if err != nil {
+    return err
+  }
+  written, err := io.Copy(tmpfile, r)
+  if closeErr := tmpfile.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil && written != size {
+    err = fmt.Errorf("wrote %d bytes of %s but expected %d", written, key, size)
+  }
+  if err != nil {
+    os.Remove(tmpfile.Name())
+    return err
+  }
+  return os.Rename(tmpfile.Name(), path)
+}
+
+// storeMetadata replaces the object's metadata, as a PUT does on S3.
+func (destination *LocalDestination) storeMetadata(key string, meta map[string][]string) error {
+  if len(meta) == 0 {
+    if err := os.Remove(destination.metaPath(key)); err != nil && !os.IsNotExist(err) {
+      return err
+    }
+    return nil
+  }
+  metaBytes, err := json.Marshal(meta)
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(destination.metaPath(key), metaBytes, 0644)
+}
+
+func (destination *LocalDestination) Metadata(key string) (map[string][]string, error) {
+  if _, err := os.Stat(destination.path(key)); err != nil {
+    return nil, err
+  }
+  metaBytes, err := ioutil.ReadFile(destination.metaPath(key))
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  var meta map[string][]string
+  if err = json.Unmarshal(metaBytes, &meta); err != nil {
+    return nil, fmt.Errorf("metadata of %s: %s", key, err)
+  }
+  return meta, nil
+}
+
+func (destination *LocalDestination) Get(key string) ([]byte, error) {
+  return ioutil.ReadFile(destination.path(key))
+}
+
+func (destination *LocalDestination) GetTail(key string, tailBytes int64) ([]byte, bool, error) {
+  file, err := os.Open(destination.path(key))
+  if err != nil {
+    return nil, false, err
+  }
+  defer file.Close()
+  info, err := file.Stat()
+  if err != nil {
+    return nil, false, err
+  }
+  start := info.Size() - tailBytes
+  if start < 0 {
+    start = 0
+  }
+  if _, err = file.Seek(start, 0); err != nil {
+    return nil, false, err
+  }
+  contents, err := ioutil.ReadAll(file)
+  return contents, start == 0, err
+}
+
+func (destination *LocalDestination) Stat(key string) (int64, string, error) {
+  info, err := os.Stat(destination.path(key))
+  if err != nil {
+    return 0, "", err
+  }
+  return info.Size(), "", nil
+}
+
+func (destination *LocalDestination) Exists(key string) (bool, error) {
+  _, err := os.Stat(destination.path(key))
+  if os.IsNotExist(err) {
+    return false, nil
+  }
+  return err == nil, err
+}
+
+// Delete succeeds when there's nothing to delete, as it does on S3.
+func (destination *LocalDestination) Delete(key string) error {
+  for _, path := range []string{destination.path(key), destination.metaPath(key)} {
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+      return err
+    }
+  }
+  return nil
+}
+
+// List walks the directory prefix falls in, under every root a key with the prefix could be
+// written under, sorting the keys it finds since walking a directory tree doesn't give them in
+// S3's order ("a-b" sorts before "a/b").
+func (destination *LocalDestination) List(prefix string, marker string) (*DestinationListing, error) {
+  keys := make([]DestinationKey, 0)
+  roots := map[string]bool{destination.KeyRoot(prefix): true}
+  for topicPrefix, topicRoot := range destination.TopicRoots {
+    if strings.HasPrefix(topicPrefix, prefix) {
+      roots[topicRoot] = true
+    }
+  }
+  for root := range roots {
+    rootKeys, err := destination.listRoot(root, prefix, marker)
+    if err != nil {
+      return nil, err
+    }
+    keys = append(keys, rootKeys...)
+  }
+  sort.Slice(keys, func(a, b int) bool { return keys[a].Key < keys[b].Key })
+  listing := &DestinationListing{Contents: keys}
+  if len(keys) > DESTINATION_LIST_MAX_KEYS {
+    listing.Contents = keys[:DESTINATION_LIST_MAX_KEYS]
+    listing.IsTruncated = true
+  }
+  return listing, nil
+}
+
+// listRoot lists the keys under prefix written under root, leaving out files under it that
+// belong to another root, as they would when one root is inside another.
+func (destination *LocalDestination) listRoot(root string, prefix string, marker string) ([]DestinationKey, error) {
+  keys := make([]DestinationKey, 0)
+  walkRoot := filepath.Join(root, filepath.FromSlash(prefix[:strings.LastIndex(prefix, "/") + 1]))
+  err := filepath.Walk(walkRoot, func(path string, info os.FileInfo, err error) error {
+    if os.IsNotExist(err) {
+      return nil
+    } else if err != nil {
+      return err
+    }
+    if info.IsDir() || strings.HasPrefix(info.Name(), LOCAL_TEMP_PREFIX) || strings.HasPrefix(info.Name(), LOCAL_META_PREFIX) {
+      return nil
+    }
+    relative, err := filepath.Rel(root, path)
+    if err != nil {
+      return err
+    }
+    key := filepath.ToSlash(relative)
+    if strings.HasPrefix(key, prefix) && key > marker && destination.KeyRoot(key) == root {
+      keys = append(keys, DestinationKey{Key: key, Size: info.Size()})
+    }
+    return nil
+  })
+  return keys, err
+}
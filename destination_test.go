@@ -0,0 +1,167 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "crypto/md5"
+  "encoding/base64"
+  "encoding/hex"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+
+  "github.com/crowdmob/goamz/aws"
+  "github.com/crowdmob/goamz/s3"
+)
+
+// fakeS3 keeps what's PUT to it with the request's headers, and answers HEADs the way S3 does:
+// the MD5 as the ETag, unless the object is SSE-KMS encrypted, whose ETag is something else.
+type fakeS3 struct {
+  lock    sync.Mutex
+  objects map[string][]byte
+  headers map[string]http.Header
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  fake.lock.Lock()
+  defer fake.lock.Unlock()
+  switch r.Method {
+  case "PUT":
+    body, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+      w.WriteHeader(http.StatusInternalServerError)
+      return
+    }
+    fake.objects[r.URL.Path], fake.headers[r.URL.Path] = body, r.Header
+  case "HEAD":
+    body, ok := fake.objects[r.URL.Path]
+    if !ok {
+      w.WriteHeader(http.StatusNotFound)
+      return
+    }
+    sum := md5.Sum(body)
+    etag := hex.EncodeToString(sum[:])
+    sse := fake.headers[r.URL.Path].Get("x-amz-server-side-encryption")
+    if sse == SSE_KMS {
+      etag = strings.Repeat("0", 32)
+    }
+    if len(sse) > 0 {
+      w.Header().Set("x-amz-server-side-encryption", sse)
+    }
+    w.Header().Set("ETag", "\"" + etag + "\"")
+    w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+  default:
+    w.WriteHeader(http.StatusMethodNotAllowed)
+  }
+}
+
+func newFakeS3Destination(t *testing.T, sse string) (*fakeS3, *S3Destination) {
+  fake := &fakeS3{objects: make(map[string][]byte), headers: make(map[string]http.Header)}
+  server := httptest.NewServer(fake)
+  t.Cleanup(server.Close)
+  region, err := S3EndpointRegion("", server.URL, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  bucket := s3.New(aws.Auth{AccessKey: "access", SecretKey: "secret"}, region).Bucket("logs")
+  return fake, &S3Destination{Bucket: bucket, SSE: sse, SSEKMSKeyId: "alias/logs"}
+}
+
+func TestS3DestinationPutOptions(t *testing.T) {
+  for _, c := range []struct {
+    sse      string
+    expected s3.Options
+  }{
+    {"", s3.Options{}},
+    {SSE_NONE, s3.Options{}},
+    {SSE_AES256, s3.Options{SSE: true}},
+    {SSE_KMS, s3.Options{SSEKMS: true, SSEKMSKeyId: "alias/logs"}},
+  } {
+    destination := &S3Destination{SSE: c.sse, SSEKMSKeyId: "alias/logs"}
+    options := destination.PutOptions(nil)
+    if options.SSE != c.expected.SSE || options.SSEKMS != c.expected.SSEKMS || options.SSEKMSKeyId != c.expected.SSEKMSKeyId {
+      t.Errorf("sse=%q PutOptions = %+v, want %+v", c.sse, options, c.expected)
+    }
+  }
+}
+
+func TestS3DestinationStoreSSE(t *testing.T) {
+  contents := "t_clicks-p_0-o_42|payload\n"
+  sum := md5.Sum([]byte(contents))
+  for _, c := range []struct {
+    sse      string
+    header   string
+    keyId    string
+    statsMD5 bool
+  }{
+    {"", "", "", true},
+    {SSE_AES256, SSE_AES256, "", true},
+    {SSE_KMS, SSE_KMS, "alias/logs", false},
+  } {
+    fake, destination := newFakeS3Destination(t, c.sse)
+    if err := destination.Store("clicks/p0/object", strings.NewReader(contents), int64(len(contents)), "text/plain", nil); err != nil {
+      t.Fatalf("sse=%q Store: %s", c.sse, err)
+    }
+    headers := fake.headers["/logs/clicks/p0/object"]
+    if sse := headers.Get("x-amz-server-side-encryption"); sse != c.header {
+      t.Errorf("sse=%q sent x-amz-server-side-encryption %q, want %q", c.sse, sse, c.header)
+    }
+    if keyId := headers.Get("x-amz-server-side-encryption-aws-kms-key-id"); keyId != c.keyId {
+      t.Errorf("sse=%q sent the KMS key id %q, want %q", c.sse, keyId, c.keyId)
+    }
+    if contentMD5 := headers.Get("Content-MD5"); contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+      t.Errorf("sse=%q sent Content-MD5 %q, want the contents' MD5", c.sse, contentMD5)
+    }
+
+    size, storedMD5, err := destination.Stat("clicks/p0/object")
+    if err != nil || size != int64(len(contents)) {
+      t.Fatalf("sse=%q Stat = %d, %v, want %d bytes", c.sse, size, err, len(contents))
+    }
+    if expected := hex.EncodeToString(sum[:]); c.statsMD5 && storedMD5 != expected {
+      t.Errorf("sse=%q Stat MD5 = %q, want %q", c.sse, storedMD5, expected)
+    } else if !c.statsMD5 && storedMD5 != "" {
+      t.Errorf("sse=%q Stat MD5 = %q, an SSE-KMS ETag isn't the object's MD5", c.sse, storedMD5)
+    }
+  }
+}
+
+// A topic with a base directory of its own is written, listed and recovered from there, and
+// the other topics and in-progress mirrors stay under the root.
+func TestLocalDestinationTopicRoots(t *testing.T) {
+  clicks, views := "clicks", "views"
+  destination := &LocalDestination{Root: t.TempDir(), TopicRoots: map[string]string{S3TopicPrefix(&clicks): t.TempDir()}}
+  contents := "t_clicks-p_0-o_42|payload\n"
+  for _, key := range []string{S3TopicPartitionPrefix(&clicks, 0) + "object", S3TopicPartitionPrefix(&views, 0) + "object", S3_IN_PROGRESS_PREFIX + S3TopicPartitionPrefix(&clicks, 0) + "current"} {
+    if err := destination.Store(key, strings.NewReader(contents), int64(len(contents)), "text/plain", nil); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for key, root := range map[string]string{
+    S3TopicPartitionPrefix(&clicks, 0) + "object": destination.TopicRoots[S3TopicPrefix(&clicks)],
+    S3TopicPartitionPrefix(&views, 0) + "object": destination.Root,
+    S3_IN_PROGRESS_PREFIX + S3TopicPartitionPrefix(&clicks, 0) + "current": destination.Root,
+  } {
+    if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(key))); err != nil {
+      t.Errorf("%s isn't under %s: %s", key, root, err)
+    }
+  }
+
+  listing, err := destination.List(S3TopicPartitionPrefix(&clicks, 0), "")
+  if err != nil || len(listing.Contents) != 1 || listing.Contents[0].Key != S3TopicPartitionPrefix(&clicks, 0) + "object" {
+    t.Errorf("List(%s) = %+v, %v, want the one object under the topic's base directory", S3TopicPartitionPrefix(&clicks, 0), listing, err)
+  }
+  if listing, err = destination.List("", ""); err != nil || len(listing.Contents) != 3 {
+    t.Errorf("List everything = %+v, %v, want the 3 objects across both directories", listing, err)
+  }
+  if recovery := RecoverS3Offset(destination, &clicks, 0, 1); recovery.Err != nil || recovery.Offset != 42 {
+    t.Errorf("RecoverS3Offset = %+v, want Offset:42 from the topic's base directory", recovery)
+  }
+}
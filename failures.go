@@ -0,0 +1,62 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "encoding/json"
+  "os"
+  "sync"
+  "time"
+)
+
+// Set in main when `faileduploadsfile` is configured, nil otherwise.
+var failedUploads *FailedUploadLog
+
+type FailedUpload struct {
+  Topic       string    `json:"topic"`
+  Partition   int64     `json:"partition"`
+  FirstOffset uint64    `json:"first_offset"`
+  LastOffset  uint64    `json:"last_offset"`
+  Messages    int64     `json:"messages"`
+  DeadLetter  bool      `json:"dead_letter"`
+  Error       string    `json:"error"`
+  FailedAt    time.Time `json:"failed_at"`
+}
+
+// FailedUploadLog appends a JSON line for every flush that failed all its upload attempts, an
+// audit trail of exactly which offset ranges need reconciling, whether or not the retry
+// queue later manages to upload them.
+type FailedUploadLog struct {
+  Path string
+  lock sync.Mutex
+}
+
+func (failureLog *FailedUploadLog) Record(chunkBuffer *ChunkBuffer, cause error) error {
+  line, err := json.Marshal(&FailedUpload{
+    Topic: *chunkBuffer.Topic,
+    Partition: chunkBuffer.Partition,
+    FirstOffset: chunkBuffer.firstOffset,
+    LastOffset: chunkBuffer.Offset,
+    Messages: chunkBuffer.messageCount,
+    DeadLetter: chunkBuffer.DeadLetter,
+    Error: cause.Error(),
+    FailedAt: time.Now(),
+  })
+  if err != nil {
+    return err
+  }
+
+  failureLog.lock.Lock()
+  defer failureLog.lock.Unlock()
+  logFile, err := os.OpenFile(failureLog.Path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  if err != nil {
+    return err
+  }
+  defer logFile.Close()
+  if _, err = logFile.Write(append(line, '\n')); err != nil {
+    return err
+  }
+  return logFile.Sync()
+}
@@ -0,0 +1,125 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "hash/crc32"
+  "strings"
+  "time"
+  "unicode/utf8"
+)
+
+const (
+  OUTPUT_FORMAT_LEGACY = "legacy"
+  OUTPUT_FORMAT_JSONL = "jsonl"
+  OUTPUT_FORMAT_RAW = "raw"
+  OUTPUT_FORMAT_PARQUET = "parquet"
+)
+
+// `outputformat` in [default], overridden per topic by `outputformat` in a [topic:<name>] section.
+var defaultOutputFormat = OUTPUT_FORMAT_LEGACY
+var outputFormats = make(map[string]string)
+
+func TopicOutputFormat(topic string) string {
+  if format, ok := outputFormats[topic]; ok {
+    return format
+  }
+  return defaultOutputFormat
+}
+
+// `schemaversion` in [default], overridden per topic the same way, tagged on every object
+// as x-amz-meta-schema-version.
+var defaultSchemaVersion string
+var schemaVersions = make(map[string]string)
+
+func TopicSchemaVersion(topic string) string {
+  if version, ok := schemaVersions[topic]; ok {
+    return version
+  }
+  return defaultSchemaVersion
+}
+
+func ValidOutputFormat(format string) bool {
+  return format == OUTPUT_FORMAT_LEGACY || format == OUTPUT_FORMAT_JSONL || format == OUTPUT_FORMAT_RAW || format == OUTPUT_FORMAT_PARQUET
+}
+
+// JSONRecord is one line of the jsonl format.  Payloads that aren't valid UTF-8 go in
+// payload_base64 instead of payload, so nothing is mangled on the way through JSON.
+type JSONRecord struct {
+  Topic         string `json:"topic"`
+  Partition     int64  `json:"partition"`
+  Offset        uint64 `json:"offset"`
+  IngestTs      int64  `json:"ingest_ts,omitempty"`
+  Crc32c        string `json:"crc32c,omitempty"`
+  Payload       string `json:"payload,omitempty"`
+  PayloadBase64 []byte `json:"payload_base64,omitempty"`
+}
+
+// EncodeRecord returns the pieces of a record's line, without the newline, in the given format.
+// Legacy lines are the guid (see RecordHeader) followed by the fields, raw lines are just the
+// fields, and jsonl lines are a JSONRecord of the fields.  Parquet buffers hold raw lines until
+// they're converted on upload.
+func EncodeRecord(format string, topic *string, partition int64, offset uint64, fields ...[]byte) [][]byte {
+  switch format {
+  case OUTPUT_FORMAT_RAW, OUTPUT_FORMAT_PARQUET:
+    return fields
+  case OUTPUT_FORMAT_JSONL:
+    payload := bytes.Join(fields, nil)
+    record := JSONRecord{Topic: *topic, Partition: partition, Offset: offset}
+    if ingestTimestamps {
+      record.IngestTs = now().UnixNano() / int64(time.Millisecond)
+    }
+    if recordChecksum {
+      record.Crc32c = fmt.Sprintf("%08x", crc32.Checksum(payload, crc32cTable))
+    }
+    if utf8.Valid(payload) {
+      record.Payload = string(payload)
+    } else {
+      record.PayloadBase64 = payload
+    }
+    line, _ := json.Marshal(record) // can't fail, it's all strings and numbers
+    return [][]byte{line}
+  }
+  return append([][]byte{RecordHeader(topic, partition, offset, fields...)}, fields...)
+}
+
+// RecordOffsetParser returns how to read the offset back out of a line of the given format,
+// or nil for raw lines and parquet, which don't hold one.  Legacy lines start with the given
+// `recordheader`, or with either when header is "".
+func RecordOffsetParser(format string, header string, topic *string, partition int64) func(line string) (uint64, bool) {
+  switch format {
+  case OUTPUT_FORMAT_RAW, OUTPUT_FORMAT_PARQUET:
+    return nil
+  case OUTPUT_FORMAT_JSONL:
+    return func(line string) (uint64, bool) {
+      if !strings.HasPrefix(line, "{") {
+        return 0, false
+      }
+      var record JSONRecord
+      if json.Unmarshal([]byte(line), &record) != nil || record.Topic != *topic || record.Partition != partition {
+        return 0, false
+      }
+      return record.Offset, true
+    }
+  }
+  guidPrefix := KafkaMsgGuidPrefix(topic, partition)
+  switch header {
+  case RECORD_HEADER_COMPACT:
+    return ParseCompactOffset
+  case RECORD_HEADER_TEXT:
+    return func(line string) (uint64, bool) {
+      return ParseGuidOffset(line, guidPrefix)
+    }
+  }
+  return func(line string) (uint64, bool) {
+    if offset, ok := ParseCompactOffset(line); ok {
+      return offset, true
+    }
+    return ParseGuidOffset(line, guidPrefix)
+  }
+}
@@ -0,0 +1,204 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+)
+
+const (
+  FRAMING_NEWLINE = "newline"
+  FRAMING_LENGTH_PREFIXED = "lengthprefixed"
+  FRAMING_VARINT_PREFIXED = "varint"
+  LENGTH_PREFIX_SIZE = 4
+  META_FRAMING = "framing"
+  META_RECORD_HEADER = "record-header"
+)
+
+// Set from `framing` in main, writing and reading records both go through it so they can't drift.
+var recordFraming RecordFraming = NewlineFraming{}
+
+// RecordFraming delimits records in buffer files and objects.
+type RecordFraming interface {
+  // Frame returns the pieces to write for a record made of the given pieces.
+  Frame(pieces [][]byte) [][]byte
+  // RecordEnd is the length of the first framed record in contents, and whether it's complete.
+  RecordEnd(contents []byte) (int, bool)
+  // Unframe strips the framing off a complete record.
+  Unframe(framed []byte) []byte
+}
+
+// NewlineFraming ends every record with a newline, so payloads mustn't contain any.
+type NewlineFraming struct{}
+
+func (framing NewlineFraming) Frame(pieces [][]byte) [][]byte {
+  return append(pieces, []byte("\n"))
+}
+
+func (framing NewlineFraming) RecordEnd(contents []byte) (int, bool) {
+  newline := bytes.IndexByte(contents, '\n')
+  if newline < 0 {
+    return len(contents), false
+  }
+  return newline + 1, true
+}
+
+func (framing NewlineFraming) Unframe(framed []byte) []byte {
+  return bytes.TrimSuffix(framed, []byte("\n"))
+}
+
+// LengthPrefixedFraming starts every record with its length as a 4 byte big endian integer,
+// so payloads can hold anything.
+type LengthPrefixedFraming struct{}
+
+func (framing LengthPrefixedFraming) Frame(pieces [][]byte) [][]byte {
+  var length uint32 = 0
+  for _, piece := range pieces {
+    length += uint32(len(piece))
+  }
+  prefix := make([]byte, LENGTH_PREFIX_SIZE)
+  binary.BigEndian.PutUint32(prefix, length)
+  return append([][]byte{prefix}, pieces...)
+}
+
+func (framing LengthPrefixedFraming) RecordEnd(contents []byte) (int, bool) {
+  if len(contents) < LENGTH_PREFIX_SIZE {
+    return len(contents), false
+  }
+  end := LENGTH_PREFIX_SIZE + int64(binary.BigEndian.Uint32(contents[:LENGTH_PREFIX_SIZE]))
+  if end > int64(len(contents)) {
+    return len(contents), false
+  }
+  return int(end), true
+}
+
+func (framing LengthPrefixedFraming) Unframe(framed []byte) []byte {
+  return framed[LENGTH_PREFIX_SIZE:]
+}
+
+// VarintPrefixedFraming starts every record with its length as a uvarint, a single byte for
+// records under 128 bytes.
+type VarintPrefixedFraming struct{}
+
+func (framing VarintPrefixedFraming) Frame(pieces [][]byte) [][]byte {
+  var length uint64 = 0
+  for _, piece := range pieces {
+    length += uint64(len(piece))
+  }
+  prefix := make([]byte, binary.MaxVarintLen64)
+  prefix = prefix[:binary.PutUvarint(prefix, length)]
+  return append([][]byte{prefix}, pieces...)
+}
+
+func (framing VarintPrefixedFraming) RecordEnd(contents []byte) (int, bool) {
+  length, n := binary.Uvarint(contents)
+  if n <= 0 {
+    return len(contents), false
+  }
+  end := uint64(n) + length
+  if end > uint64(len(contents)) {
+    return len(contents), false
+  }
+  return int(end), true
+}
+
+func (framing VarintPrefixedFraming) Unframe(framed []byte) []byte {
+  _, n := binary.Uvarint(framed)
+  return framed[n:]
+}
+
+// SplitRecords returns the complete records in contents, without their framing, and how many
+// bytes of contents they take up; anything after that is a partially written record.
+func SplitRecords(framing RecordFraming, contents []byte) ([][]byte, int) {
+  records := make([][]byte, 0)
+  consumed := 0
+  for consumed < len(contents) {
+    end, complete := framing.RecordEnd(contents[consumed:])
+    if !complete {
+      break
+    }
+    records = append(records, framing.Unframe(contents[consumed:consumed+end]))
+    consumed += end
+  }
+  return records, consumed
+}
+
+// FramingNamed is the framing `framing` calls name, false when it's none of them.
+func FramingNamed(name string) (RecordFraming, bool) {
+  switch name {
+  case "", FRAMING_NEWLINE:
+    return NewlineFraming{}, true
+  case FRAMING_LENGTH_PREFIXED:
+    return LengthPrefixedFraming{}, true
+  case FRAMING_VARINT_PREFIXED:
+    return VarintPrefixedFraming{}, true
+  }
+  return nil, false
+}
+
+// FramingName is what `framing` calls framing.
+func FramingName(framing RecordFraming) string {
+  switch framing.(type) {
+  case LengthPrefixedFraming:
+    return FRAMING_LENGTH_PREFIXED
+  case VarintPrefixedFraming:
+    return FRAMING_VARINT_PREFIXED
+  }
+  return FRAMING_NEWLINE
+}
+
+// RecordLayout is how an object's records are framed and what header they start with, which
+// objects carry in their metadata so a change of `framing` or `recordheader` doesn't leave the
+// objects written before it unreadable.
+type RecordLayout struct {
+  Framing RecordFraming
+  Header  string // RECORD_HEADER_TEXT or RECORD_HEADER_COMPACT, "" when it isn't known
+}
+
+// CurrentRecordLayout is the layout records are written in now.
+func CurrentRecordLayout() RecordLayout {
+  if compactRecordHeader {
+    return RecordLayout{Framing: recordFraming, Header: RECORD_HEADER_COMPACT}
+  }
+  return RecordLayout{Framing: recordFraming, Header: RECORD_HEADER_TEXT}
+}
+
+// AddTo records the layout in an object's metadata.
+func (layout RecordLayout) AddTo(meta map[string][]string) {
+  meta[META_FRAMING] = []string{FramingName(layout.Framing)}
+  if len(layout.Header) > 0 {
+    meta[META_RECORD_HEADER] = []string{layout.Header}
+  }
+}
+
+func (layout RecordLayout) String() string {
+  if len(layout.Header) == 0 {
+    return FramingName(layout.Framing)
+  }
+  return FramingName(layout.Framing) + "/" + layout.Header
+}
+
+// ObjectRecordLayout reads the layout an object was stored with from its metadata.  Objects
+// stored before the layout was recorded are newline framed, with either header.
+func ObjectRecordLayout(destination Destination, key string) (RecordLayout, error) {
+  layout := RecordLayout{Framing: NewlineFraming{}}
+  meta, err := destination.Metadata(key)
+  if err != nil {
+    return layout, err
+  }
+  if values := meta[META_FRAMING]; len(values) > 0 {
+    framing, ok := FramingNamed(values[0])
+    if !ok {
+      return layout, fmt.Errorf("%s has framing `%s`, which this version can't read", key, values[0])
+    }
+    layout.Framing = framing
+  }
+  if values := meta[META_RECORD_HEADER]; len(values) > 0 && (values[0] == RECORD_HEADER_TEXT || values[0] == RECORD_HEADER_COMPACT) {
+    layout.Header = values[0]
+  }
+  return layout, nil
+}
@@ -0,0 +1,142 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sort"
+  "sync"
+  "time"
+)
+
+const (
+  HEALTH_OK = "ok"
+  HEALTH_DEGRADED = "degraded"
+  HEALTH_DOWN = "down"
+)
+
+// Set in main when `healthaddr` is configured, nil otherwise.
+var health *HealthTracker
+
+type PartitionHealth struct {
+  Topic       string    `json:"topic"`
+  Partition   int64     `json:"partition"`
+  Alive       bool      `json:"alive"`
+  Healthy     bool      `json:"healthy"`
+  LastFlushAt time.Time `json:"last_flush_at"`
+  LastIdleAt  time.Time `json:"last_idle_at"`
+  LastError   string    `json:"last_error,omitempty"`
+  LastErrorAt time.Time `json:"last_error_at"`
+}
+
+// HealthTracker aggregates per-partition liveness and flush results into one state: ok when
+// every partition is healthy, down when none is, degraded in between.  A partition is
+// unhealthy when its broker has stopped, its last upload failed, or it hasn't flushed
+// successfully, nor been idle with nothing to flush, for MaxStale (when set).
+type HealthTracker struct {
+  MaxStale   time.Duration
+  DegradedOK bool // answer 200 for degraded, so only an instance with every partition stuck is shed
+  startedAt  time.Time
+  lock       sync.Mutex
+  partitions map[string]*PartitionHealth
+}
+
+func NewHealthTracker(maxStale time.Duration, degradedOK bool) *HealthTracker {
+  return &HealthTracker{
+    MaxStale: maxStale,
+    DegradedOK: degradedOK,
+    startedAt: time.Now(),
+    partitions: make(map[string]*PartitionHealth),
+  }
+}
+
+func (tracker *HealthTracker) partition(topic string, partition int64) *PartitionHealth {
+  name := fmt.Sprintf("%s#%d", topic, partition)
+  if _, ok := tracker.partitions[name]; !ok {
+    tracker.partitions[name] = &PartitionHealth{Topic: topic, Partition: partition}
+  }
+  return tracker.partitions[name]
+}
+
+func (tracker *HealthTracker) SetAlive(topic string, partition int64, alive bool) {
+  tracker.lock.Lock()
+  defer tracker.lock.Unlock()
+  tracker.partition(topic, partition).Alive = alive
+}
+
+func (tracker *HealthTracker) Flushed(topic string, partition int64) {
+  tracker.lock.Lock()
+  defer tracker.lock.Unlock()
+  tracker.partition(topic, partition).LastFlushAt = time.Now()
+}
+
+// Idle records that the partition had nothing buffered or uploading, so a quiet topic doesn't
+// go stale.  It doesn't clear a failed upload, only a flush does.
+func (tracker *HealthTracker) Idle(topic string, partition int64) {
+  tracker.lock.Lock()
+  defer tracker.lock.Unlock()
+  tracker.partition(topic, partition).LastIdleAt = time.Now()
+}
+
+func (tracker *HealthTracker) Failed(topic string, partition int64, err error) {
+  tracker.lock.Lock()
+  defer tracker.lock.Unlock()
+  partitionHealth := tracker.partition(topic, partition)
+  partitionHealth.LastError = err.Error()
+  partitionHealth.LastErrorAt = time.Now()
+}
+
+// State is the aggregate state, along with a snapshot of every partition's health.
+func (tracker *HealthTracker) State() (string, []PartitionHealth) {
+  tracker.lock.Lock()
+  defer tracker.lock.Unlock()
+
+  snapshot := make([]PartitionHealth, 0, len(tracker.partitions))
+  healthy := 0
+  for _, partitionHealth := range tracker.partitions {
+    lastSuccess := partitionHealth.LastFlushAt
+    if partitionHealth.LastIdleAt.After(lastSuccess) {
+      lastSuccess = partitionHealth.LastIdleAt
+    }
+    if lastSuccess.IsZero() {
+      lastSuccess = tracker.startedAt
+    }
+    partitionHealth.Healthy = partitionHealth.Alive && !partitionHealth.LastErrorAt.After(partitionHealth.LastFlushAt) &&
+      (tracker.MaxStale <= 0 || time.Since(lastSuccess) < tracker.MaxStale)
+    if partitionHealth.Healthy {
+      healthy++
+    }
+    snapshot = append(snapshot, *partitionHealth)
+  }
+
+  switch {
+  case healthy == len(snapshot) && healthy > 0:
+    return HEALTH_OK, snapshot
+  case healthy == 0:
+    return HEALTH_DOWN, snapshot
+  }
+  return HEALTH_DEGRADED, snapshot
+}
+
+func (tracker *HealthTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  state, partitions := tracker.State()
+  status := http.StatusOK
+  if state == HEALTH_DOWN || (state == HEALTH_DEGRADED && !tracker.DegradedOK) {
+    status = http.StatusServiceUnavailable
+  }
+  // named up front, so whoever reads a failed probe sees which partitions are stuck
+  unhealthy := make([]string, 0)
+  for _, partitionHealth := range partitions {
+    if !partitionHealth.Healthy {
+      unhealthy = append(unhealthy, fmt.Sprintf("%s#%d", partitionHealth.Topic, partitionHealth.Partition))
+    }
+  }
+  sort.Strings(unhealthy)
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(map[string]interface{}{"state": state, "unhealthy": unhealthy, "partitions": partitions})
+}
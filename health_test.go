@@ -0,0 +1,59 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// A partition that hasn't flushed within healthmaxstaleseconds fails the probe, named in the
+// body, unless healthdegradedok lets a partly stuck instance answer 200.
+func TestHealthStalePartition(t *testing.T) {
+  for _, c := range []struct {
+    degradedOK bool
+    status     int
+  }{
+    {false, http.StatusServiceUnavailable},
+    {true, http.StatusOK},
+  } {
+    tracker := NewHealthTracker(time.Minute, c.degradedOK)
+    tracker.SetAlive("clicks", 0, true)
+    tracker.SetAlive("clicks", 1, true)
+    tracker.Flushed("clicks", 0)
+    tracker.Flushed("clicks", 1)
+    tracker.partition("clicks", 1).LastFlushAt = time.Now().Add(-2 * time.Minute)
+
+    recorder := httptest.NewRecorder()
+    tracker.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+    var body struct {
+      State     string   `json:"state"`
+      Unhealthy []string `json:"unhealthy"`
+    }
+    if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+      t.Fatal(err)
+    }
+    if recorder.Code != c.status || body.State != HEALTH_DEGRADED {
+      t.Errorf("degradedok=%v answered %d %s, want %d degraded", c.degradedOK, recorder.Code, body.State, c.status)
+    }
+    if len(body.Unhealthy) != 1 || body.Unhealthy[0] != "clicks#1" {
+      t.Errorf("degradedok=%v named %v unhealthy, want the stale clicks#1", c.degradedOK, body.Unhealthy)
+    }
+  }
+}
+
+func TestHealthAllFresh(t *testing.T) {
+  tracker := NewHealthTracker(time.Minute, false)
+  tracker.SetAlive("clicks", 0, true)
+  tracker.Flushed("clicks", 0)
+  recorder := httptest.NewRecorder()
+  tracker.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+  if recorder.Code != http.StatusOK {
+    t.Errorf("every partition fresh answered %d, want 200", recorder.Code)
+  }
+}
@@ -0,0 +1,121 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strconv"
+)
+
+const (
+  LEFTOVER_BUFFERS_KEEP = "keep"
+  LEFTOVER_BUFFERS_UPLOAD = "upload"
+  LEFTOVER_BUFFERS_DELETE = "delete"
+)
+
+// Matches the names BaseFilename gives buffer files.
+var leftoverBufferPattern = regexp.MustCompile(`^kafka-s3-go-consumer-buffer-topic_(.+)-partition_(\d+)-offset_(\d+)-`)
+
+// HandleLeftoverBuffers deals with the buffer files a previous run left behind in dir, per
+// the `leftoverbuffers` policy.  It runs before offset recovery, so whatever gets uploaded
+// here is resumed after.  It returns the `topic#partition`s with a leftover it had to keep.
+func HandleLeftoverBuffers(dir string, policy string, compression string, destination Destination) map[string]bool {
+  kept := make(map[string]bool)
+  entries, err := ioutil.ReadDir(dir)
+  if err != nil {
+    if !os.IsNotExist(err) {
+      Log.Warnf("Couldn't look for leftover bufferfiles in %s: %s", dir, err)
+    }
+    return kept
+  }
+
+  for _, entry := range entries {
+    match := leftoverBufferPattern.FindStringSubmatch(entry.Name())
+    if match == nil || entry.IsDir() { continue }
+    leftoverPath := filepath.Join(dir, entry.Name())
+
+    switch policy {
+    case LEFTOVER_BUFFERS_DELETE:
+      Log.Infof("Deleting leftover bufferfile %s", leftoverPath)
+      if err = os.Remove(leftoverPath); err != nil {
+        Log.Warnf("Error deleting leftover bufferfile %s: %#v", leftoverPath, err)
+      }
+    case LEFTOVER_BUFFERS_UPLOAD:
+      partition, _ := strconv.ParseInt(match[2], 10, 64)
+      if err = UploadLeftoverBuffer(leftoverPath, match[1], partition, compression, destination); err != nil {
+        Log.Warnf("Couldn't upload leftover bufferfile %s, keeping it: %s", leftoverPath, err)
+        kept[match[1] + "#" + match[2]] = true
+        continue
+      }
+      if !keepBufferFiles {
+        if err = os.Remove(leftoverPath); err != nil {
+          Log.Warnf("Error deleting leftover bufferfile %s: %#v", leftoverPath, err)
+        }
+      }
+    default:
+      Log.Infof("Keeping leftover bufferfile %s", leftoverPath)
+      kept[match[1] + "#" + match[2]] = true
+    }
+  }
+  return kept
+}
+
+// UploadLeftoverBuffer uploads the complete records of a leftover buffer file, decompressing
+// it first if it was stream compressed, since its stream was never finished.
+func UploadLeftoverBuffer(leftoverPath string, topic string, partition int64, compression string, destination Destination) error {
+  contents, err := ioutil.ReadFile(leftoverPath)
+  if err != nil {
+    return err
+  }
+  if len(compression) > 0 {
+    if contents, err = DecompressTruncated(compression, contents); err != nil {
+      return err
+    }
+  }
+  records, complete := SplitRecords(recordFraming, contents)
+  contents = contents[:complete] // drop a half written last record
+
+  format := TopicOutputFormat(topic)
+  parseOffset := RecordOffsetParser(format, CurrentRecordLayout().Header, &topic, partition)
+  if parseOffset == nil {
+    return fmt.Errorf("%s records don't hold their offsets", format)
+  }
+  chunkBuffer := &ChunkBuffer{Topic: &topic, Partition: partition, Format: format}
+  for _, record := range records {
+    if offset, ok := parseOffset(string(record)); ok {
+      if chunkBuffer.messageCount == 0 {
+        chunkBuffer.firstOffset = offset
+      }
+      chunkBuffer.Offset = offset
+      chunkBuffer.messageCount++
+    }
+  }
+  if chunkBuffer.messageCount == 0 {
+    Log.Infof("Leftover bufferfile %s holds no complete records", leftoverPath)
+    return nil
+  }
+
+  // upload from a cleaned up copy, leaving the original as it was should this fail
+  chunkBuffer.File, err = ioutil.TempFile(filepath.Dir(leftoverPath), "kafka-s3-go-consumer-leftover-")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(chunkBuffer.File.Name())
+  _, err = chunkBuffer.File.Write(contents)
+  chunkBuffer.File.Close()
+  if err != nil {
+    return err
+  }
+
+  chunkBuffer.Log().Infof("Uploading %d records (Offset:%d-%d) from leftover bufferfile %s", chunkBuffer.messageCount, chunkBuffer.firstOffset, chunkBuffer.Offset, leftoverPath)
+  if _, err = chunkBuffer.Upload(destination); err == nil {
+    chunkBuffer.recordUploadedOffset()
+  }
+  return err
+}
@@ -0,0 +1,62 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "fmt"
+  "log"
+  "os"
+  "strings"
+)
+
+const (
+  LOG_DEBUG = iota
+  LOG_INFO
+  LOG_WARN
+  LOG_ERROR
+)
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// `loglevel` in [default], one of DEBUG, INFO, WARN or ERROR.  Lines below it aren't written.
+var logLevel = LOG_INFO
+var stdLogger = log.New(os.Stdout, "", log.LstdFlags)
+
+func ParseLogLevel(name string) (int, bool) {
+  for level, levelName := range logLevelNames {
+    if strings.EqualFold(name, levelName) {
+      return level, true
+    }
+  }
+  return 0, false
+}
+
+// Logger writes timestamped lines at a level, tagged with what they're about, the topic#partition
+// for everything a broker goroutine or ChunkBuffer logs.  Log is the untagged one main uses.
+type Logger struct {
+  Tag string
+}
+
+var Log = &Logger{}
+
+func PartitionLogger(topic string, partition int64) *Logger {
+  return &Logger{Tag: fmt.Sprintf("%s#%d", topic, partition)}
+}
+
+func (logger *Logger) logf(level int, format string, args ...interface{}) {
+  if level < logLevel {
+    return
+  }
+  line := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+  if logger.Tag != "" {
+    line = "[" + logger.Tag + "] " + line
+  }
+  stdLogger.Printf("%-5s %s\n", logLevelNames[level], line)
+}
+
+func (logger *Logger) Debugf(format string, args ...interface{}) { logger.logf(LOG_DEBUG, format, args...) }
+func (logger *Logger) Infof(format string, args ...interface{}) { logger.logf(LOG_INFO, format, args...) }
+func (logger *Logger) Warnf(format string, args ...interface{}) { logger.logf(LOG_WARN, format, args...) }
+func (logger *Logger) Errorf(format string, args ...interface{}) { logger.logf(LOG_ERROR, format, args...) }
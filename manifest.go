@@ -0,0 +1,56 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "encoding/json"
+  "time"
+)
+
+const (
+  S3_MANIFEST_SUFFIX = ".manifest"
+)
+
+// `writemanifest` in [default].
+var writeManifests bool
+
+// Manifest is the `.manifest` sidecar written next to each data object with writemanifest on, so
+// downstream jobs can tell what an object holds without reading it.  Kafka 0.7 messages carry
+// no timestamp, so the timestamps are when the first and last of them were read, in unix
+// milliseconds, and left out when that isn't known (buffers left over from a previous run).
+type Manifest struct {
+  Topic        string `json:"topic"`
+  Partition    int64  `json:"partition"`
+  FirstOffset  uint64 `json:"first_offset"`
+  LastOffset   uint64 `json:"last_offset"`
+  MessageCount int64  `json:"message_count"`
+  Bytes        int64  `json:"bytes"`
+  MinTimestamp int64  `json:"min_timestamp,omitempty"`
+  MaxTimestamp int64  `json:"max_timestamp,omitempty"`
+}
+
+// Manifest describes the buffer once it's been written as an object of size bytes.
+func (chunkBuffer *ChunkBuffer) Manifest(size int64) *Manifest {
+  return &Manifest{Topic: *chunkBuffer.Topic,
+    Partition: chunkBuffer.Partition,
+    FirstOffset: chunkBuffer.firstOffset,
+    LastOffset: chunkBuffer.Offset,
+    MessageCount: chunkBuffer.messageCount,
+    Bytes: size,
+    MinTimestamp: chunkBuffer.oldestMessageAt / int64(time.Millisecond),
+    MaxTimestamp: chunkBuffer.newestMessageAt / int64(time.Millisecond),
+  }
+}
+
+// PutManifestSidecar writes manifest next to s3path.  Like the index, it's only written once the
+// data object exists, so a manifest never describes an object that isn't there.
+func PutManifestSidecar(destination Destination, s3path string, manifest *Manifest) error {
+  manifestJson, err := json.Marshal(manifest)
+  if err != nil {
+    return err
+  }
+  Log.Debugf("Put Object: { Destination: %s, Key: %s%s, Messages: %d }", destination.Name(), s3path, S3_MANIFEST_SUFFIX, manifest.MessageCount)
+  return PutWithRetry(destination, s3path + S3_MANIFEST_SUFFIX, manifestJson, "application/json", nil)
+}
@@ -0,0 +1,161 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "sort"
+  "sync"
+  "time"
+)
+
+const (
+  METRICS_PREFIX = "kafka_s3_consumer_"
+  METRICS_LAG_INTERVAL = 30 * time.Second
+)
+
+// Upper bounds, in seconds, of the upload latency histogram's buckets.
+var metricsUploadBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Set in main when `metricsaddr` is configured, nil otherwise.
+var metrics *Metrics
+
+type PartitionMetrics struct {
+  Topic          string
+  Partition      int64
+  Consumed       int64
+  Skipped        int64
+  ConsumedBytes  int64
+  BufferedBytes  int64
+  Rotations      int64
+  Uploads        int64
+  UploadFailures int64
+  uploadBuckets  []int64
+  uploadSeconds  float64
+  OffsetLag      int64
+  offsetLagKnown bool
+}
+
+// Metrics keeps per-partition counters for Prometheus, labelled by topic and partition only,
+// so there are never more series than partitions.
+type Metrics struct {
+  lock       sync.Mutex
+  partitions map[string]*PartitionMetrics
+}
+
+func NewMetrics() *Metrics {
+  return &Metrics{partitions: make(map[string]*PartitionMetrics)}
+}
+
+func (collector *Metrics) partition(topic string, partition int64) *PartitionMetrics {
+  name := fmt.Sprintf("%s#%d", topic, partition)
+  if _, ok := collector.partitions[name]; !ok {
+    collector.partitions[name] = &PartitionMetrics{Topic: topic, Partition: partition, uploadBuckets: make([]int64, len(metricsUploadBuckets))}
+  }
+  return collector.partitions[name]
+}
+
+// Consumed counts a message read from the broker, and sets how much the partition has buffered.
+func (collector *Metrics) Consumed(topic string, partition int64, payloadBytes int, bufferedBytes int64) {
+  collector.lock.Lock()
+  defer collector.lock.Unlock()
+  partitionMetrics := collector.partition(topic, partition)
+  partitionMetrics.Consumed++
+  partitionMetrics.ConsumedBytes += int64(payloadBytes)
+  partitionMetrics.BufferedBytes = bufferedBytes
+}
+
+// Skipped adds the messages the broker skipped, which it only reports once it stops.
+func (collector *Metrics) Skipped(topic string, partition int64, skipped int64) {
+  collector.lock.Lock()
+  defer collector.lock.Unlock()
+  collector.partition(topic, partition).Skipped += skipped
+}
+
+func (collector *Metrics) Rotated(topic string, partition int64) {
+  collector.lock.Lock()
+  defer collector.lock.Unlock()
+  partitionMetrics := collector.partition(topic, partition)
+  partitionMetrics.Rotations++
+  partitionMetrics.BufferedBytes = 0
+}
+
+func (collector *Metrics) Uploaded(topic string, partition int64, took time.Duration, err error) {
+  collector.lock.Lock()
+  defer collector.lock.Unlock()
+  partitionMetrics := collector.partition(topic, partition)
+  if err != nil {
+    partitionMetrics.UploadFailures++
+    return
+  }
+  partitionMetrics.Uploads++
+  partitionMetrics.uploadSeconds += took.Seconds()
+  for b, bound := range metricsUploadBuckets {
+    if took.Seconds() <= bound {
+      partitionMetrics.uploadBuckets[b]++
+    }
+  }
+}
+
+// SetOffsetLag records how far, in bytes since 0.7 offsets are byte positions, the partition's
+// last buffered message is behind the broker's latest offset.
+func (collector *Metrics) SetOffsetLag(topic string, partition int64, lag int64) {
+  collector.lock.Lock()
+  defer collector.lock.Unlock()
+  partitionMetrics := collector.partition(topic, partition)
+  partitionMetrics.OffsetLag = lag
+  partitionMetrics.offsetLagKnown = true
+}
+
+// ServeHTTP writes every metric in the Prometheus text format, partitions in name order.
+func (collector *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  collector.lock.Lock()
+  names := make([]string, 0, len(collector.partitions))
+  for name, _ := range collector.partitions {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  snapshot := make([]PartitionMetrics, len(names))
+  for n, name := range names {
+    snapshot[n] = *collector.partitions[name]
+    snapshot[n].uploadBuckets = append([]int64{}, collector.partitions[name].uploadBuckets...)
+  }
+  collector.lock.Unlock()
+
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+  write := func(name string, kind string, help string, value func(p *PartitionMetrics) (int64, bool)) {
+    fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", METRICS_PREFIX, name, help, METRICS_PREFIX, name, kind)
+    for p, _ := range snapshot {
+      if v, ok := value(&snapshot[p]); ok {
+        fmt.Fprintf(w, "%s%s{%s} %d\n", METRICS_PREFIX, name, metricsLabels(&snapshot[p]), v)
+      }
+    }
+  }
+  write("messages_consumed_total", "counter", "Messages read from the broker.", func(p *PartitionMetrics) (int64, bool) { return p.Consumed, true })
+  write("messages_skipped_total", "counter", "Messages the broker skipped, typically corrupted, counted when it stops.", func(p *PartitionMetrics) (int64, bool) { return p.Skipped, true })
+  write("consumed_bytes_total", "counter", "Payload bytes read from the broker.", func(p *PartitionMetrics) (int64, bool) { return p.ConsumedBytes, true })
+  write("buffered_bytes", "gauge", "Bytes written to the current buffer.", func(p *PartitionMetrics) (int64, bool) { return p.BufferedBytes, true })
+  write("buffer_rotations_total", "counter", "Buffers rotated out for upload.", func(p *PartitionMetrics) (int64, bool) { return p.Rotations, true })
+  write("uploads_total", "counter", "Buffers uploaded.", func(p *PartitionMetrics) (int64, bool) { return p.Uploads, true })
+  write("upload_failures_total", "counter", "Buffers whose upload failed after every retry.", func(p *PartitionMetrics) (int64, bool) { return p.UploadFailures, true })
+  write("offset_lag_bytes", "gauge", "Bytes between the last buffered offset and the broker's latest.", func(p *PartitionMetrics) (int64, bool) { return p.OffsetLag, p.offsetLagKnown })
+
+  name := METRICS_PREFIX + "upload_duration_seconds"
+  fmt.Fprintf(w, "# HELP %s Time taken by successful buffer uploads, retries included.\n# TYPE %s histogram\n", name, name)
+  for p, _ := range snapshot {
+    labels := metricsLabels(&snapshot[p])
+    for b, bound := range metricsUploadBuckets {
+      fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, snapshot[p].uploadBuckets[b])
+    }
+    fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, snapshot[p].Uploads)
+    fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, snapshot[p].uploadSeconds)
+    fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, snapshot[p].Uploads)
+  }
+}
+
+func metricsLabels(partitionMetrics *PartitionMetrics) string {
+  return fmt.Sprintf("topic=%q,partition=\"%d\"", partitionMetrics.Topic, partitionMetrics.Partition)
+}
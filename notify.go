@@ -0,0 +1,107 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sync"
+  "time"
+
+  "github.com/crowdmob/goamz/sns"
+)
+
+const (
+  NOTIFY_MAX_ATTEMPTS = 5
+  NOTIFY_INITIAL_BACKOFF = 1 * time.Second
+  NOTIFY_HTTP_TIMEOUT = 10 * time.Second
+)
+
+// Set in main when `notifyurl` or `notifysnsarn` is configured, nil otherwise.
+var notifier Notifier
+var pendingNotifications sync.WaitGroup
+
+// FlushEvent describes an object that has just landed in S3.
+type FlushEvent struct {
+  Bucket      string `json:"bucket"`
+  Key         string `json:"key"`
+  Topic       string `json:"topic"`
+  Partition   int64  `json:"partition"`
+  FirstOffset uint64 `json:"first_offset"`
+  LastOffset  uint64 `json:"last_offset"`
+}
+
+type Notifier interface {
+  Notify(event *FlushEvent) error
+}
+
+type WebhookNotifier struct {
+  URL    string
+  Client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+  return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: NOTIFY_HTTP_TIMEOUT}}
+}
+
+func (webhook *WebhookNotifier) Notify(event *FlushEvent) error {
+  body, err := json.Marshal(event)
+  if err != nil {
+    return err
+  }
+  resp, err := webhook.Client.Post(webhook.URL, "application/json", bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    return fmt.Errorf("webhook %s responded with %s", webhook.URL, resp.Status)
+  }
+  return nil
+}
+
+type SNSNotifier struct {
+  TopicArn string
+  SNS      *sns.SNS
+}
+
+func (snsNotifier *SNSNotifier) Notify(event *FlushEvent) error {
+  body, err := json.Marshal(event)
+  if err != nil {
+    return err
+  }
+  _, err = snsNotifier.SNS.Publish(&sns.PublishOptions{
+    Message: string(body),
+    Subject: "kafka-s3-consumer flush",
+    TopicArn: snsNotifier.TopicArn,
+  })
+  return err
+}
+
+// NotifyInBackground delivers the event without blocking the caller, retrying
+// with exponential backoff. Failures are only logged: the upload has already
+// succeeded and must not be affected by a flaky notification target.
+func NotifyInBackground(n Notifier, event *FlushEvent) {
+  pendingNotifications.Add(1)
+  go func() {
+    defer pendingNotifications.Done()
+    backoff := NOTIFY_INITIAL_BACKOFF
+    for attempt := 1; attempt <= NOTIFY_MAX_ATTEMPTS; attempt++ {
+      err := n.Notify(event)
+      if err == nil {
+        Log.Debugf("Notified flush of %s (attempt %d)", event.Key, attempt)
+        return
+      }
+      Log.Warnf("Failed to notify flush of %s (attempt %d/%d): %s", event.Key, attempt, NOTIFY_MAX_ATTEMPTS, err)
+      if attempt < NOTIFY_MAX_ATTEMPTS {
+        time.Sleep(backoff)
+        backoff *= 2
+      }
+    }
+    Log.Errorf("Giving up notifying flush of %s", event.Key)
+  }()
+}
@@ -0,0 +1,63 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "fmt"
+  "io/ioutil"
+
+  "github.com/xitongsys/parquet-go-source/buffer"
+  "github.com/xitongsys/parquet-go/parquet"
+  "github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+  S3_PARQUET_SUFFIX = ".parquet"
+  PARQUET_CONTENT_TYPE = "application/vnd.apache.parquet"
+  DEFAULT_PARQUET_ROW_GROUP_BYTES = 128 * 1024 * 1024
+)
+
+// `parquetschema` in [default], overridden per topic the same way as outputformat.  Schemas
+// are files in parquet-go's JSON schema format, read once at startup.
+var defaultParquetSchema string
+var parquetSchemas = make(map[string]string)
+var parquetRowGroupBytes int64 = DEFAULT_PARQUET_ROW_GROUP_BYTES
+
+func TopicParquetSchema(topic string) string {
+  if schema, ok := parquetSchemas[topic]; ok {
+    return schema
+  }
+  return defaultParquetSchema
+}
+
+func ReadParquetSchema(path string) (string, error) {
+  schemaBytes, err := ioutil.ReadFile(path)
+  if err != nil {
+    return "", fmt.Errorf("couldn't read parquetschema %s: %s", path, err)
+  }
+  return string(schemaBytes), nil
+}
+
+// ParquetFromRecords writes a buffer's records, each a JSON document, as the rows of a
+// snappy compressed Parquet file.  Parquet files are only readable once finished, so unlike
+// the line formats this can't happen as records arrive.
+func ParquetFromRecords(schema string, records [][]byte) ([]byte, error) {
+  parquetFile := buffer.NewBufferFile()
+  parquetWriter, err := writer.NewJSONWriter(schema, parquetFile, 1)
+  if err != nil {
+    return nil, err
+  }
+  parquetWriter.RowGroupSize = parquetRowGroupBytes
+  parquetWriter.CompressionType = parquet.CompressionCodec_SNAPPY
+  for r, record := range records {
+    if err = parquetWriter.Write(string(record)); err != nil {
+      return nil, fmt.Errorf("record %d doesn't fit the parquet schema: %s", r, err)
+    }
+  }
+  if err = parquetWriter.WriteStop(); err != nil {
+    return nil, err
+  }
+  return parquetFile.Bytes(), nil
+}
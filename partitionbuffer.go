@@ -0,0 +1,224 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "sync"
+  "sync/atomic"
+)
+
+// PartitionBuffer is a partition's current buffer, and its dead letter buffer when schemas are
+// validated, shared by the consume callback, the flush ticker, the drain and the final flush.
+// Every method holds its lock, rotation included, so a buffer is never appended to while it's
+// uploaded.  Rotated out buffers are uploaded right away or, given upload slots, by a
+// background uploader that keeps the partition's objects in offset order.
+type PartitionBuffer struct {
+  lock            sync.Mutex
+  buffer          *ChunkBuffer
+  deadLetters     *ChunkBuffer
+  destination     Destination
+  uploads         chan *ChunkBuffer // nil when uploading in the foreground
+  uploadSlots     chan bool
+  uploadsPending  sync.WaitGroup
+  uploadsInFlight int32 // uploadsPending's count, which a WaitGroup won't tell
+  uploadPanic     interface{} // set before the upload's pending count is released
+  OnUploadPanic   func()
+  // the partition resumes at the offset of the last message archived before the restart,
+  // which a 0.7 broker reads again, offsets being where a message starts
+  ResumesArchived bool
+}
+
+// NewPartitionBuffer takes buffer, and deadLetters unless it's nil, with their files created.
+// With uploadSlots, rotated out buffers upload in the background, at most cap(uploadSlots) at
+// once across every partition sharing them.
+func NewPartitionBuffer(buffer *ChunkBuffer, deadLetters *ChunkBuffer, destination Destination, uploadSlots chan bool) *PartitionBuffer {
+  partitionBuffer := &PartitionBuffer{buffer: buffer, deadLetters: deadLetters, destination: destination, uploadSlots: uploadSlots}
+  if uploadSlots != nil {
+    partitionBuffer.uploads = make(chan *ChunkBuffer, UPLOAD_QUEUE_DEPTH)
+    go partitionBuffer.uploadInBackground()
+  }
+  return partitionBuffer
+}
+
+// An upload that panics stops the uploader from uploading anything after it, those buffer
+// files are left for leftoverbuffers, in order.
+func (partitionBuffer *PartitionBuffer) uploadInBackground() {
+  for rotatedOutBuffer := range partitionBuffer.uploads {
+    if partitionBuffer.uploadPanic != nil {
+      rotatedOutBuffer.closeBufferFile()
+      atomic.AddInt32(&partitionBuffer.uploadsInFlight, -1)
+      partitionBuffer.uploadsPending.Done()
+      continue
+    }
+    partitionBuffer.uploadSlots <- true
+    func() {
+      defer func() {
+        if r := recover(); r != nil {
+          partitionBuffer.uploadPanic = r
+          if partitionBuffer.OnUploadPanic != nil {
+            partitionBuffer.OnUploadPanic()
+          }
+        }
+        <-partitionBuffer.uploadSlots
+        atomic.AddInt32(&partitionBuffer.uploadsInFlight, -1)
+        partitionBuffer.uploadsPending.Done()
+      }()
+      rotatedOutBuffer.StoreToS3AndRelease(partitionBuffer.destination)
+    }()
+  }
+}
+
+// rotate swaps *slot for a new buffer and uploads the old one, callers must hold the lock.
+func (partitionBuffer *PartitionBuffer) rotate(slot **ChunkBuffer) {
+  rotatedOutBuffer := *slot
+  rotatedOutBuffer.Log().Debugf("Log Rotation needed! Rotating out of %s", rotatedOutBuffer.File.Name())
+
+  *slot = rotatedOutBuffer.Successor()
+  (*slot).CreateBufferFileOrPanic()
+
+  rotatedOutBuffer.Log().Debugf("Rotating into %s", (*slot).File.Name())
+  if metrics != nil && !rotatedOutBuffer.DeadLetter {
+    metrics.Rotated(*rotatedOutBuffer.Topic, rotatedOutBuffer.Partition)
+  }
+
+  if partitionBuffer.uploads != nil {
+    // uploaded after the successor has started, whose mirror would be the one deleted
+    rotatedOutBuffer.DeleteInProgress(partitionBuffer.destination)
+    atomic.AddInt32(&partitionBuffer.uploadsInFlight, 1)
+    partitionBuffer.uploadsPending.Add(1)
+    partitionBuffer.uploads <- rotatedOutBuffer
+  } else {
+    rotatedOutBuffer.StoreToS3AndRelease(partitionBuffer.destination)
+  }
+}
+
+// rotateIfNeeded is RotateIfNeeded for callers holding the lock.  An empty buffer that's due
+// only has its clock restarted, there's nothing to upload.
+func (partitionBuffer *PartitionBuffer) rotateIfNeeded() bool {
+  if !partitionBuffer.buffer.NeedsRotation() {
+    return false
+  }
+  if partitionBuffer.buffer.messageCount == 0 {
+    partitionBuffer.buffer.restartClock()
+    return false
+  }
+  partitionBuffer.rotate(&partitionBuffer.buffer)
+  return true
+}
+
+// SkipResumed is whether msg, the first message read, is the last one archived before the
+// restart.  Messages of a compressed message set share an offset, so only the first is
+// skipped, which can leave duplicates but never loses one.
+func (partitionBuffer *PartitionBuffer) SkipResumed(msg KafkaMessage) bool {
+  partitionBuffer.lock.Lock()
+  defer partitionBuffer.lock.Unlock()
+  if !partitionBuffer.ResumesArchived {
+    return false
+  }
+  partitionBuffer.ResumesArchived = false
+  return msg.Offset() == partitionBuffer.buffer.Offset
+}
+
+// Append buffers a message, rotating the buffer when that makes it due.  A message too big to
+// buffer is stored on its own, after what's buffered has been uploaded, so objects stay in
+// offset order.  It returns whether the buffer was rotated for being due.
+func (partitionBuffer *PartitionBuffer) Append(msg KafkaMessage) bool {
+  partitionBuffer.lock.Lock()
+  defer partitionBuffer.lock.Unlock()
+  buffer := partitionBuffer.buffer
+  if buffer.Oversized(msg) {
+    buffer.Log().Infof("Offset:%d is %d bytes, beyond maxchunksizebytes, storing it in an object of its own", msg.Offset(), len(msg.Payload()))
+    if buffer.messageCount > 0 {
+      partitionBuffer.rotate(&partitionBuffer.buffer)
+    }
+    partitionBuffer.uploadsPending.Wait()
+    partitionBuffer.buffer.StoreOversizedMessage(partitionBuffer.destination, msg)
+  } else {
+    buffer.PutMessage(msg)
+  }
+  if metrics != nil {
+    metrics.Consumed(*buffer.Topic, buffer.Partition, len(msg.Payload()), partitionBuffer.buffer.length)
+  }
+  return partitionBuffer.rotateIfNeeded()
+}
+
+// AppendDeadLetter buffers a rejected message, with why, in the dead letter buffer.
+func (partitionBuffer *PartitionBuffer) AppendDeadLetter(msg KafkaMessage, reason string) {
+  partitionBuffer.lock.Lock()
+  defer partitionBuffer.lock.Unlock()
+  partitionBuffer.deadLetters.PutDeadLetter(msg, reason)
+  if partitionBuffer.deadLetters.NeedsRotation() {
+    partitionBuffer.rotate(&partitionBuffer.deadLetters)
+  }
+}
+
+// RotateIfNeeded rotates the buffer when it's due by size, age or latency.
+func (partitionBuffer *PartitionBuffer) RotateIfNeeded() bool {
+  partitionBuffer.lock.Lock()
+  defer partitionBuffer.lock.Unlock()
+  return partitionBuffer.rotateIfNeeded()
+}
+
+// Rotate rotates the buffer if it holds anything, due or not.
+func (partitionBuffer *PartitionBuffer) Rotate() bool {
+  partitionBuffer.lock.Lock()
+  defer partitionBuffer.lock.Unlock()
+  if partitionBuffer.buffer.messageCount == 0 {
+    return false
+  }
+  partitionBuffer.rotate(&partitionBuffer.buffer)
+  return true
+}
+
+// Maintain mirrors the buffer to its in-progress object and checkpoints it, when they're due.
+func (partitionBuffer *PartitionBuffer) Maintain() {
+  partitionBuffer.lock.Lock()
+  defer partitionBuffer.lock.Unlock()
+  buffer := partitionBuffer.buffer
+  if buffer.InProgressDue() {
+    if err := buffer.UploadInProgress(partitionBuffer.destination); err != nil {
+      buffer.Log().Warnf("Couldn't upload in-progress object %s: %s", buffer.InProgressKey(), err)
+    }
+  }
+  if buffer.CheckpointDue() {
+    if err := buffer.Checkpoint(); err != nil {
+      buffer.Log().Warnf("Couldn't checkpoint %s: %s", buffer.File.Name(), err)
+    }
+  }
+}
+
+// Offset is the offset of the last message buffered.
+func (partitionBuffer *PartitionBuffer) Offset() uint64 {
+  partitionBuffer.lock.Lock()
+  defer partitionBuffer.lock.Unlock()
+  return partitionBuffer.buffer.Offset
+}
+
+// Idle is whether nothing is buffered or being uploaded.
+func (partitionBuffer *PartitionBuffer) Idle() bool {
+  partitionBuffer.lock.Lock()
+  defer partitionBuffer.lock.Unlock()
+  return partitionBuffer.buffer.messageCount == 0 && atomic.LoadInt32(&partitionBuffer.uploadsInFlight) == 0
+}
+
+// Flush uploads whatever is left once consuming has stopped, after everything rotated out
+// before it.  If a background upload panicked, the buffer file is left for leftoverbuffers and
+// Flush panics with the upload's panic.
+func (partitionBuffer *PartitionBuffer) Flush() {
+  partitionBuffer.uploadsPending.Wait()
+  if partitionBuffer.uploads != nil {
+    close(partitionBuffer.uploads)
+  }
+  partitionBuffer.lock.Lock()
+  defer partitionBuffer.lock.Unlock()
+  if partitionBuffer.uploadPanic != nil {
+    partitionBuffer.buffer.closeBufferFile()
+    panic(partitionBuffer.uploadPanic)
+  }
+  partitionBuffer.buffer.StoreToS3AndRelease(partitionBuffer.destination)
+  if partitionBuffer.deadLetters != nil {
+    partitionBuffer.deadLetters.StoreToS3AndRelease(partitionBuffer.destination)
+  }
+}
@@ -0,0 +1,233 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "testing"
+
+  "github.com/crowdmob/kafka"
+)
+
+func newTestPartitionBuffer(t *testing.T, topic *string, partition int64, destination Destination, uploadSlots chan bool) *PartitionBuffer {
+  return NewPartitionBuffer(newTestChunkBuffer(t, topic, partition), nil, destination, uploadSlots)
+}
+
+// storedPayloads counts every payload in the objects under root, leaving out sidecars, metadata
+// and in-progress mirrors, and fails if an in-progress mirror outlived the final flush.
+func storedPayloads(t *testing.T, root string) map[string]int {
+  payloads := make(map[string]int)
+  err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+    if err != nil || info.IsDir() {
+      return err
+    }
+    key := filepath.ToSlash(strings.TrimPrefix(path, root + string(filepath.Separator)))
+    if strings.HasPrefix(key, S3_IN_PROGRESS_PREFIX) {
+      t.Errorf("in-progress mirror %s is still there after the final flush", key)
+      return nil
+    }
+    if IsSidecarKey(key) || strings.HasPrefix(info.Name(), LOCAL_META_PREFIX) {
+      return nil
+    }
+    contents, err := ioutil.ReadFile(path)
+    if err != nil {
+      return err
+    }
+    for _, line := range strings.Split(strings.TrimRight(string(contents), "\n"), "\n") {
+      payloads[line[strings.LastIndex(line, "|") + 1:]]++
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  return payloads
+}
+
+// Run with -race: the consume callback appends to each partition while its ticker rotates,
+// mirrors and checks it and the background uploaders upload what's rotated out, then the final
+// flush has to leave every message in exactly one object.
+func TestPartitionBufferConcurrentAppendAndFlush(t *testing.T) {
+  previousInProgressSeconds := inProgressSeconds
+  inProgressSeconds = 1
+  defer func() { inProgressSeconds = previousInProgressSeconds }()
+
+  for _, uploadWorkers := range []int{0, 2} {
+    t.Run(fmt.Sprintf("uploadworkers=%d", uploadWorkers), func(t *testing.T) {
+      destination := &LocalDestination{Root: t.TempDir()}
+      var uploadSlots chan bool
+      if uploadWorkers > 0 {
+        uploadSlots = make(chan bool, uploadWorkers)
+      }
+      topic := "clicks"
+      partitionBuffers := []*PartitionBuffer{
+        newTestPartitionBuffer(t, &topic, 0, destination, uploadSlots),
+        newTestPartitionBuffer(t, &topic, 1, destination, uploadSlots),
+      }
+
+      const messages = 2000
+      var wg sync.WaitGroup
+      for p, partitionBuffer := range partitionBuffers {
+        consumerDone := make(chan bool)
+        wg.Add(2)
+        go func(p int, partitionBuffer *PartitionBuffer) {
+          defer wg.Done()
+          defer close(consumerDone)
+          for n := 0; n < messages; n++ {
+            partitionBuffer.Append(kafka.NewMessage([]byte(fmt.Sprintf("p%d-m%d", p, n))))
+          }
+        }(p, partitionBuffer)
+        go func(partitionBuffer *PartitionBuffer) {
+          defer wg.Done()
+          for {
+            select {
+            case <-consumerDone:
+              return
+            default:
+            }
+            partitionBuffer.RotateIfNeeded()
+            partitionBuffer.Rotate()
+            partitionBuffer.Maintain()
+            partitionBuffer.Idle()
+            partitionBuffer.Offset()
+          }
+        }(partitionBuffer)
+      }
+      wg.Wait()
+      for _, partitionBuffer := range partitionBuffers {
+        partitionBuffer.Flush()
+      }
+
+      payloads := storedPayloads(t, destination.Root)
+      if len(payloads) != messages * len(partitionBuffers) {
+        t.Errorf("stored %d distinct messages, want %d", len(payloads), messages * len(partitionBuffers))
+      }
+      for payload, count := range payloads {
+        if count != 1 {
+          t.Errorf("%q was stored %d times", payload, count)
+        }
+      }
+    })
+  }
+}
+
+func TestPartitionBufferIdleRestartsClock(t *testing.T) {
+  destination := &LocalDestination{Root: t.TempDir()}
+  topic := "clicks"
+  partitionBuffer := newTestPartitionBuffer(t, &topic, 0, destination, nil)
+  partitionBuffer.buffer.expiresAt, partitionBuffer.buffer.hardExpiresAt = 0, 0
+
+  if partitionBuffer.RotateIfNeeded() {
+    t.Errorf("RotateIfNeeded rotated an empty buffer")
+  }
+  if partitionBuffer.buffer.NeedsRotation() {
+    t.Errorf("an empty buffer that was due is still due, its clock wasn't restarted")
+  }
+  if !partitionBuffer.Idle() {
+    t.Errorf("an empty buffer with nothing uploading isn't idle")
+  }
+  partitionBuffer.Flush()
+}
+
+// testMessage is a message at an offset of our choosing, which a *kafka.Message only gets
+// from a broker.
+type testMessage struct {
+  offset  uint64
+  payload []byte
+}
+
+func (msg *testMessage) Offset() uint64 { return msg.offset }
+func (msg *testMessage) Payload() []byte { return msg.payload }
+
+// storedOffsets counts every offset in the objects of topic#partition under root.
+func storedOffsets(t *testing.T, root string, topic *string, partition int64) map[uint64]int {
+  offsets := make(map[uint64]int)
+  guidPrefix := KafkaMsgGuidPrefix(topic, partition)
+  err := filepath.Walk(filepath.Join(root, filepath.FromSlash(S3TopicPartitionPrefix(topic, partition))), func(path string, info os.FileInfo, err error) error {
+    if err != nil || info.IsDir() || IsSidecarKey(path) || strings.HasPrefix(info.Name(), LOCAL_META_PREFIX) {
+      return err
+    }
+    contents, err := ioutil.ReadFile(path)
+    if err != nil {
+      return err
+    }
+    for _, line := range strings.Split(strings.TrimRight(string(contents), "\n"), "\n") {
+      if offset, ok := ParseGuidOffset(line, guidPrefix); ok {
+        offsets[offset]++
+      } else {
+        t.Errorf("%s holds a line without an offset: %q", path, line)
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  return offsets
+}
+
+// A partition restarted after its last upload resumes at that upload's last offset, which the
+// broker reads again, so that message must be skipped for no offset to be archived twice, and
+// nothing else may be: a broker reset past it starts at a message that was never archived.
+func TestPartitionBufferRestartAfterUpload(t *testing.T) {
+  for _, replayFrom := range []uint64{104, 105} {
+    t.Run(fmt.Sprintf("replay from %d", replayFrom), func(t *testing.T) {
+      destination := &LocalDestination{Root: t.TempDir()}
+      topic := "clicks"
+      beforeRestart := newTestPartitionBuffer(t, &topic, 0, destination, nil)
+      for offset := uint64(100); offset <= 104; offset++ {
+        beforeRestart.Append(&testMessage{offset, []byte(fmt.Sprintf("m%d", offset))})
+      }
+      beforeRestart.Flush()
+
+      recovery := RecoverS3Offset(destination, &topic, 0, 1)
+      if recovery.Err != nil || !recovery.Archived || recovery.Offset != 104 {
+        t.Fatalf("RecoverS3Offset = %+v, want the archived Offset:104", recovery)
+      }
+      buffer := newTestChunkBuffer(t, &topic, 0)
+      buffer.Offset = recovery.Offset
+      afterRestart := NewPartitionBuffer(buffer, nil, destination, nil)
+      afterRestart.ResumesArchived = recovery.Archived
+      for offset := replayFrom; offset <= 109; offset++ {
+        msg := &testMessage{offset, []byte(fmt.Sprintf("m%d", offset))}
+        if !afterRestart.SkipResumed(msg) {
+          afterRestart.Append(msg)
+        }
+      }
+      afterRestart.Flush()
+
+      offsets := storedOffsets(t, destination.Root, &topic, 0)
+      for offset := uint64(100); offset <= 109; offset++ {
+        if offsets[offset] != 1 {
+          t.Errorf("Offset:%d was archived %d times, want once", offset, offsets[offset])
+        }
+      }
+      if len(offsets) != 10 {
+        t.Errorf("archived offsets %v, want 100 to 109", offsets)
+      }
+    })
+  }
+}
+
+// A partition that has never been archived starts at its first message, which is kept.
+func TestPartitionBufferFirstRunKeepsFirstMessage(t *testing.T) {
+  destination := &LocalDestination{Root: t.TempDir()}
+  topic := "clicks"
+  recovery := RecoverS3Offset(destination, &topic, 0, 1)
+  if recovery.Err != nil || recovery.Archived {
+    t.Fatalf("RecoverS3Offset = %+v, want nothing archived", recovery)
+  }
+  partitionBuffer := newTestPartitionBuffer(t, &topic, 0, destination, nil)
+  partitionBuffer.ResumesArchived = recovery.Archived
+  if first := kafka.NewMessage([]byte("first")); partitionBuffer.SkipResumed(first) {
+    t.Errorf("skipped Offset:%d of a partition that was never archived", first.Offset())
+  }
+  partitionBuffer.Flush()
+}
@@ -0,0 +1,36 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "time"
+)
+
+// TokenBucket limits a rate to PerSecond events, allowing bursts of up to a second's worth.
+// It isn't safe for concurrent use, each partition's consume callback gets its own.
+type TokenBucket struct {
+  PerSecond float64
+  tokens    float64
+  filledAt  time.Time
+}
+
+func NewTokenBucket(perSecond int64) *TokenBucket {
+  return &TokenBucket{PerSecond: float64(perSecond), tokens: float64(perSecond), filledAt: time.Now()}
+}
+
+// Wait blocks until a token is available and takes it.
+func (bucket *TokenBucket) Wait() {
+  now := time.Now()
+  bucket.tokens += now.Sub(bucket.filledAt).Seconds() * bucket.PerSecond
+  if bucket.tokens > bucket.PerSecond {
+    bucket.tokens = bucket.PerSecond
+  }
+  bucket.filledAt = now
+
+  bucket.tokens--
+  if bucket.tokens < 0 {
+    time.Sleep(time.Duration(-bucket.tokens / bucket.PerSecond * float64(time.Second)))
+  }
+}
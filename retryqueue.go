@@ -0,0 +1,215 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+)
+
+const (
+  RETRY_QUEUE_INDEX_FILENAME = "index.json"
+)
+
+// Set in main when `retryqueuepath` is configured, nil otherwise.
+var retryQueue *RetryQueue
+
+type RetryQueueEntry struct {
+  File         string    `json:"file"`
+  Topic        string    `json:"topic"`
+  Partition    int64     `json:"partition"`
+  FirstOffset  uint64    `json:"first_offset"`
+  LastOffset   uint64    `json:"last_offset"`
+  MessageCount int64     `json:"message_count"`
+  DeadLetter   bool      `json:"dead_letter"`
+  Compression  string    `json:"compression,omitempty"`
+  Format       string    `json:"format,omitempty"`
+  FirstReadAt  int64     `json:"first_read_at,omitempty"`
+  LastReadAt   int64     `json:"last_read_at,omitempty"`
+  Attempts     int       `json:"attempts"`
+  LastError    string    `json:"last_error"`
+  EnqueuedAt   time.Time `json:"enqueued_at"`
+}
+
+// RetryQueue keeps buffer files whose upload failed in a directory, alongside an index
+// describing them, so they survive a restart and get uploaded once S3 is reachable again.
+type RetryQueue struct {
+  Dir     string
+  lock    sync.Mutex
+  entries []*RetryQueueEntry
+}
+
+func OpenRetryQueue(dir string) (*RetryQueue, error) {
+  err := os.MkdirAll(dir, 0700)
+  if err != nil {
+    return nil, err
+  }
+
+  queue := &RetryQueue{Dir: dir}
+  indexBytes, err := ioutil.ReadFile(queue.indexPath())
+  if os.IsNotExist(err) {
+    return queue, nil
+  } else if err != nil {
+    return nil, err
+  }
+  if err = json.Unmarshal(indexBytes, &queue.entries); err != nil {
+    return nil, fmt.Errorf("corrupt retry queue index %s: %s", queue.indexPath(), err)
+  }
+  return queue, nil
+}
+
+func (queue *RetryQueue) indexPath() string {
+  return filepath.Join(queue.Dir, RETRY_QUEUE_INDEX_FILENAME)
+}
+
+// save writes the index to a temp file and renames it into place, so a crash never
+// leaves a half written index behind.  Callers must hold the lock.
+func (queue *RetryQueue) save() error {
+  indexBytes, err := json.Marshal(queue.entries)
+  if err != nil {
+    return err
+  }
+  tmpPath := queue.indexPath() + ".tmp"
+  if err = ioutil.WriteFile(tmpPath, indexBytes, 0600); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, queue.indexPath())
+}
+
+func (queue *RetryQueue) Len() int {
+  queue.lock.Lock()
+  defer queue.lock.Unlock()
+  return len(queue.entries)
+}
+
+// Enqueue moves a closed buffer file whose upload failed into the queue.
+func (queue *RetryQueue) Enqueue(chunkBuffer *ChunkBuffer, cause error) error {
+  queue.lock.Lock()
+  defer queue.lock.Unlock()
+
+  queuedPath := filepath.Join(queue.Dir, filepath.Base(chunkBuffer.File.Name()))
+  if err := os.Rename(chunkBuffer.File.Name(), queuedPath); err != nil {
+    return err
+  }
+  queue.entries = append(queue.entries, &RetryQueueEntry{
+    File: queuedPath,
+    Topic: *chunkBuffer.Topic,
+    Partition: chunkBuffer.Partition,
+    FirstOffset: chunkBuffer.firstOffset,
+    LastOffset: chunkBuffer.Offset,
+    MessageCount: chunkBuffer.messageCount,
+    DeadLetter: chunkBuffer.DeadLetter,
+    Compression: chunkBuffer.Compression,
+    Format: chunkBuffer.Format,
+    FirstReadAt: chunkBuffer.oldestMessageAt,
+    LastReadAt: chunkBuffer.newestMessageAt,
+    Attempts: 1,
+    LastError: cause.Error(),
+    EnqueuedAt: time.Now(),
+  })
+  return queue.save()
+}
+
+// LastOffset is the highest offset held in the queue for a topic/partition.  Queued data is
+// as good as archived for offset recovery, it just hasn't reached S3 yet.
+func (queue *RetryQueue) LastOffset(topic string, partition int64) (offset uint64, found bool) {
+  queue.lock.Lock()
+  defer queue.lock.Unlock()
+  for _, entry := range queue.entries {
+    if entry.Topic == topic && entry.Partition == partition && !entry.DeadLetter && (!found || entry.LastOffset > offset) {
+      offset, found = entry.LastOffset, true
+    }
+  }
+  return offset, found
+}
+
+// Drain tries to upload every queued buffer once, returning how many are still queued.
+func (queue *RetryQueue) Drain(destination Destination) int {
+  queue.lock.Lock()
+  pending := make([]*RetryQueueEntry, len(queue.entries))
+  copy(pending, queue.entries)
+  queue.lock.Unlock()
+
+  for _, entry := range pending {
+    bufferFile, err := os.Open(entry.File)
+    if err != nil {
+      Log.Warnf("Dropping retry queue entry for missing bufferfile %s: %s", entry.File, err)
+      queue.remove(entry)
+      continue
+    }
+    bufferFile.Close()
+
+    topic := entry.Topic
+    chunkBuffer := &ChunkBuffer{File: bufferFile,
+      Topic: &topic,
+      Partition: entry.Partition,
+      Offset: entry.LastOffset,
+      firstOffset: entry.FirstOffset,
+      messageCount: entry.MessageCount,
+      DeadLetter: entry.DeadLetter,
+      Compression: entry.Compression,
+      Format: entry.Format,
+      oldestMessageAt: entry.FirstReadAt,
+      newestMessageAt: entry.LastReadAt,
+    }
+    if _, err = chunkBuffer.Upload(destination); err != nil {
+      Log.Warnf("Retry of queued bufferfile %s failed (attempt %d): %s", entry.File, entry.Attempts + 1, err)
+      queue.lock.Lock()
+      entry.Attempts++
+      entry.LastError = err.Error()
+      if saveErr := queue.save(); saveErr != nil {
+        Log.Warnf("Couldn't save retry queue index %s: %s", queue.indexPath(), saveErr)
+      }
+      queue.lock.Unlock()
+      continue
+    }
+
+    Log.Debugf("Uploaded queued bufferfile %s after %d failed attempts", entry.File, entry.Attempts)
+    // newer buffers of the partition may have been uploaded while this one waited
+    if offsetCache != nil && !entry.DeadLetter {
+      if cachedOffset, found := offsetCache.LastOffset(entry.Topic, entry.Partition); !found || entry.LastOffset > cachedOffset {
+        chunkBuffer.recordUploadedOffset()
+      }
+    }
+    queue.remove(entry)
+    if !keepBufferFiles {
+      if err = os.Remove(entry.File); err != nil {
+        Log.Warnf("Error deleting queued bufferfile %s: %#v", entry.File, err)
+      }
+    }
+  }
+  return queue.Len()
+}
+
+func (queue *RetryQueue) remove(entry *RetryQueueEntry) {
+  queue.lock.Lock()
+  defer queue.lock.Unlock()
+  for e := range queue.entries {
+    if queue.entries[e] == entry {
+      queue.entries = append(queue.entries[:e], queue.entries[e+1:]...)
+      break
+    }
+  }
+  if err := queue.save(); err != nil {
+    Log.Warnf("Couldn't save retry queue index %s: %s", queue.indexPath(), err)
+  }
+}
+
+// DrainEvery keeps retrying the queue in the background for the life of the process.
+func (queue *RetryQueue) DrainEvery(interval time.Duration, destination Destination) {
+  go func() {
+    for _ = range time.Tick(interval) {
+      if queue.Len() > 0 {
+        remaining := queue.Drain(destination)
+        Log.Debugf("Retry queue drained, %d bufferfiles still queued", remaining)
+      }
+    }
+  }()
+}
@@ -0,0 +1,153 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "github.com/crowdmob/kafka"
+)
+
+// outageDestination is a LocalDestination that fails every store while down.
+type outageDestination struct {
+  *LocalDestination
+  down bool
+}
+
+func (destination *outageDestination) Store(key string, r io.Reader, size int64, contentType string, meta map[string][]string) error {
+  if destination.down {
+    return errors.New("503 Service Unavailable")
+  }
+  return destination.LocalDestination.Store(key, r, size, contentType, meta)
+}
+
+// withRetryQueue sets the retry queue to one in dir, with put retries that don't wait, until
+// the returned func puts them back.
+func withRetryQueue(t *testing.T, dir string) func() {
+  queue, err := OpenRetryQueue(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  previousQueue, previousMaxBackoff := retryQueue, s3RetryMaxBackoff
+  retryQueue, s3RetryMaxBackoff = queue, time.Millisecond
+  return func() { retryQueue, s3RetryMaxBackoff = previousQueue, previousMaxBackoff }
+}
+
+// failedUpload buffers messages for topic#partition and stores them during an outage, so they
+// end up in the retry queue.  It returns what the buffer file held.
+func failedUpload(t *testing.T, destination *outageDestination, topic *string, partition int64, messages int) []byte {
+  buffer := newTestChunkBuffer(t, topic, partition)
+  for n := 0; n < messages; n++ {
+    buffer.PutMessage(kafka.NewMessage([]byte(fmt.Sprintf("m%d", n))))
+  }
+  buffer.closeBufferFile()
+  written, err := ioutil.ReadFile(buffer.File.Name())
+  if err != nil {
+    t.Fatal(err)
+  }
+  destination.down = true
+  defer func() { destination.down = false }()
+  if uploaded, err := buffer.StoreToS3AndRelease(destination); uploaded || err == nil {
+    t.Fatalf("StoreToS3AndRelease during an outage = %v, %v, want the upload to fail", uploaded, err)
+  }
+  if _, err = os.Stat(buffer.File.Name()); !os.IsNotExist(err) {
+    t.Errorf("bufferfile %s is still where it was written, not moved to the retry queue", buffer.File.Name())
+  }
+  return written
+}
+
+func TestRetryQueueSurvivesRestartAndDrains(t *testing.T) {
+  queueDir := t.TempDir()
+  defer withRetryQueue(t, queueDir)()
+  destination := &outageDestination{LocalDestination: &LocalDestination{Root: t.TempDir()}}
+  topic := "clicks"
+  written := failedUpload(t, destination, &topic, 3, 5)
+
+  restarted, err := OpenRetryQueue(queueDir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if restarted.Len() != 1 {
+    t.Fatalf("retry queue holds %d bufferfiles after a restart, want 1", restarted.Len())
+  }
+  if offset, found := restarted.LastOffset(topic, 3); !found || offset != 0 {
+    t.Errorf("LastOffset = %d, %v, want the queued Offset:0", offset, found)
+  }
+  queued := restarted.entries[0]
+  if queued.MessageCount != 5 || queued.Attempts != 1 || queued.LastError != "503 Service Unavailable" {
+    t.Errorf("queued %+v, want 5 messages after 1 attempt that failed with the outage", queued)
+  }
+
+  destination.down = true
+  if remaining := restarted.Drain(destination); remaining != 1 {
+    t.Fatalf("Drain during the outage left %d queued, want 1", remaining)
+  }
+  if restarted, err = OpenRetryQueue(queueDir); err != nil || restarted.entries[0].Attempts != 2 {
+    t.Fatalf("after a failed drain the index holds %+v, %v, want a second attempt saved", restarted.entries, err)
+  }
+
+  destination.down = false
+  if remaining := restarted.Drain(destination); remaining != 0 {
+    t.Fatalf("Drain after the outage left %d queued, want none", remaining)
+  }
+  listing, err := destination.List(S3TopicPartitionPrefix(&topic, 3), "")
+  if err != nil || len(listing.Contents) != 1 {
+    t.Fatalf("List = %v, %v, want the queued buffer's object", listing, err)
+  }
+  if stored, err := destination.Get(listing.Contents[0].Key); err != nil || string(stored) != string(written) {
+    t.Errorf("stored %q, %v, want the queued buffer's %q", stored, err, written)
+  }
+  if _, err = os.Stat(queued.File); !os.IsNotExist(err) {
+    t.Errorf("queued bufferfile %s is still there after it was uploaded", queued.File)
+  }
+  if restarted, err = OpenRetryQueue(queueDir); err != nil || restarted.Len() != 0 {
+    t.Errorf("after draining, the index holds %v, %v, want nothing", restarted.entries, err)
+  }
+}
+
+func TestRetryQueueLastOffset(t *testing.T) {
+  queue := &RetryQueue{Dir: t.TempDir(), entries: []*RetryQueueEntry{
+    {Topic: "clicks", Partition: 0, LastOffset: 200},
+    {Topic: "clicks", Partition: 0, LastOffset: 500},
+    {Topic: "clicks", Partition: 0, LastOffset: 900, DeadLetter: true},
+    {Topic: "clicks", Partition: 1, LastOffset: 700},
+    {Topic: "views", Partition: 0, LastOffset: 800},
+  }}
+  if offset, found := queue.LastOffset("clicks", 0); !found || offset != 500 {
+    t.Errorf("LastOffset(clicks#0) = %d, %v, want 500, dead letters don't count", offset, found)
+  }
+  if offset, found := queue.LastOffset("clicks", 2); found {
+    t.Errorf("LastOffset(clicks#2) = %d, found, want nothing queued", offset)
+  }
+}
+
+func TestRetryQueueDropsMissingBufferFiles(t *testing.T) {
+  queueDir := t.TempDir()
+  queue, err := OpenRetryQueue(queueDir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  queue.entries = []*RetryQueueEntry{{File: filepath.Join(queueDir, "gone"), Topic: "clicks", MessageCount: 1}}
+  if remaining := queue.Drain(&LocalDestination{Root: t.TempDir()}); remaining != 0 {
+    t.Errorf("Drain left %d queued, want the entry for the missing bufferfile dropped", remaining)
+  }
+}
+
+func TestOpenRetryQueueRejectsCorruptIndex(t *testing.T) {
+  queueDir := t.TempDir()
+  if err := ioutil.WriteFile(filepath.Join(queueDir, RETRY_QUEUE_INDEX_FILENAME), []byte("[{"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := OpenRetryQueue(queueDir); err == nil {
+    t.Errorf("OpenRetryQueue opened a corrupt index")
+  }
+}
@@ -0,0 +1,186 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/linkedin/goavro/v2"
+  "github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+const (
+  SCHEMA_REGISTRY_HTTP_TIMEOUT = 10 * time.Second
+  SCHEMA_REGISTRY_MIN_BACKOFF = 1 * time.Second
+  SCHEMA_REGISTRY_MAX_BACKOFF = 30 * time.Second
+  CONFLUENT_WIRE_MAGIC_BYTE = 0
+  CONFLUENT_WIRE_HEADER_SIZE = 5
+)
+
+// Set in main when `[schemaregistry] validate` is on, nil otherwise.
+var schemaValidator *SchemaRegistry
+
+type RegisteredSchema struct {
+  Id         uint32
+  SchemaType string
+  avroCodec  *goavro.Codec
+  jsonSchema *jsonschema.Schema
+}
+
+// Validate checks an encoded record, without any wire format header, against the schema.
+func (schema *RegisteredSchema) Validate(data []byte) error {
+  switch schema.SchemaType {
+  case "AVRO":
+    _, remaining, err := schema.avroCodec.NativeFromBinary(data)
+    if err != nil {
+      return err
+    }
+    if len(remaining) > 0 {
+      return fmt.Errorf("%d trailing bytes after avro record", len(remaining))
+    }
+  case "JSON":
+    var document interface{}
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.UseNumber()
+    if err := decoder.Decode(&document); err != nil {
+      return err
+    }
+    return schema.jsonSchema.Validate(document)
+  }
+  return nil
+}
+
+// SchemaUnavailableError is a registry that couldn't be reached or failed to answer, which says
+// nothing about the payload, so it's waited out rather than dead lettered.
+type SchemaUnavailableError struct {
+  Id  uint32
+  Err error
+}
+
+func (err *SchemaUnavailableError) Error() string {
+  return fmt.Sprintf("schema id %d unavailable: %s", err.Id, err.Err)
+}
+
+// SchemaRegistry validates payloads against schemas fetched from a Confluent Schema
+// Registry, caching every schema by id for the life of the process.
+type SchemaRegistry struct {
+  URL           string
+  FixedSchemaId uint32 // validate bare payloads against this id instead of reading the wire format header
+  Client        *http.Client
+  lock          sync.Mutex
+  cache         map[uint32]*RegisteredSchema
+}
+
+func NewSchemaRegistry(url string, fixedSchemaId uint32) *SchemaRegistry {
+  return &SchemaRegistry{
+    URL: strings.TrimRight(url, "/"),
+    FixedSchemaId: fixedSchemaId,
+    Client: &http.Client{Timeout: SCHEMA_REGISTRY_HTTP_TIMEOUT},
+    cache: make(map[uint32]*RegisteredSchema),
+  }
+}
+
+// Schema returns the schema registered under id, fetching it the first time.  The fetch is made
+// without holding the lock, so one partition waiting on the registry doesn't hold up the others'
+// cached lookups.  The error is a *SchemaUnavailableError when the registry couldn't answer.
+func (registry *SchemaRegistry) Schema(id uint32) (*RegisteredSchema, error) {
+  registry.lock.Lock()
+  schema, ok := registry.cache[id]
+  registry.lock.Unlock()
+  if ok {
+    return schema, nil
+  }
+
+  resp, err := registry.Client.Get(fmt.Sprintf("%s/schemas/ids/%d", registry.URL, id))
+  if err != nil {
+    return nil, &SchemaUnavailableError{Id: id, Err: err}
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+    return nil, &SchemaUnavailableError{Id: id, Err: fmt.Errorf("schema registry responded with %s", resp.Status)}
+  } else if resp.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("schema registry responded with %s for schema id %d", resp.Status, id)
+  }
+
+  var registered struct {
+    Schema     string `json:"schema"`
+    SchemaType string `json:"schemaType"`
+  }
+  if err = json.NewDecoder(resp.Body).Decode(&registered); err != nil {
+    return nil, &SchemaUnavailableError{Id: id, Err: err} // cut short on the way, most likely
+  }
+
+  schema = &RegisteredSchema{Id: id, SchemaType: registered.SchemaType}
+  switch schema.SchemaType {
+  case "", "AVRO": // the registry leaves schemaType out for avro
+    schema.SchemaType = "AVRO"
+    schema.avroCodec, err = goavro.NewCodec(registered.Schema)
+  case "JSON":
+    schema.jsonSchema, err = jsonschema.CompileString(fmt.Sprintf("%s/schemas/ids/%d", registry.URL, id), registered.Schema)
+  default:
+    Log.Warnf("Schema id %d is of unsupported type %s, its records will not be validated", id, schema.SchemaType)
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  registry.lock.Lock()
+  registry.cache[id] = schema
+  registry.lock.Unlock()
+  return schema, nil
+}
+
+// Validate returns why a payload doesn't match its schema, or nil when it does, or a
+// *SchemaUnavailableError when that can't be told for now.
+func (registry *SchemaRegistry) Validate(payload []byte) error {
+  id := registry.FixedSchemaId
+  data := payload
+  if id == 0 {
+    if len(payload) < CONFLUENT_WIRE_HEADER_SIZE || payload[0] != CONFLUENT_WIRE_MAGIC_BYTE {
+      return fmt.Errorf("missing schema registry wire format header")
+    }
+    id = binary.BigEndian.Uint32(payload[1:CONFLUENT_WIRE_HEADER_SIZE])
+    data = payload[CONFLUENT_WIRE_HEADER_SIZE:]
+  }
+
+  schema, err := registry.Schema(id)
+  if _, unavailable := err.(*SchemaUnavailableError); unavailable {
+    return err
+  } else if err != nil {
+    return fmt.Errorf("schema id %d can't be used: %s", id, err)
+  }
+  if err = schema.Validate(data); err != nil {
+    return fmt.Errorf("doesn't match schema id %d: %s", id, err)
+  }
+  return nil
+}
+
+// ValidateWhenAvailable is Validate, retrying with backoff while the registry is unavailable,
+// until it answers or done is closed, when it gives up with the *SchemaUnavailableError.
+func (registry *SchemaRegistry) ValidateWhenAvailable(payload []byte, done <-chan struct{}) error {
+  backoff := SCHEMA_REGISTRY_MIN_BACKOFF
+  for {
+    err := registry.Validate(payload)
+    if _, unavailable := err.(*SchemaUnavailableError); !unavailable {
+      return err
+    }
+    Log.Warnf("%s, retrying in %s", err, backoff)
+    select {
+    case <-done:
+      return err
+    case <-time.After(backoff):
+    }
+    if backoff *= 2; backoff > SCHEMA_REGISTRY_MAX_BACKOFF {
+      backoff = SCHEMA_REGISTRY_MAX_BACKOFF
+    }
+  }
+}
@@ -0,0 +1,87 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "time"
+
+  "github.com/crowdmob/kafka"
+)
+
+const (
+  S3_SELF_TEST_PREFIX = ".selftest/"
+  SELF_TEST_MESSAGES = 5
+)
+
+// SelfTest reads a few messages from the canary topic/partition, writes them to an object
+// under .selftest/ and lists and reads it back, reporting each step so a bad broker address,
+// region or credentials shows up at once.  It returns whether every step passed.
+func SelfTest(hostname string, topic string, partition int64, maxMessageSize uint32, destination Destination) bool {
+  earliest, err := KafkaOffsetBoundary(hostname, &topic, partition, KAFKA_OFFSET_EARLIEST)
+  if err != nil {
+    fmt.Printf("FAIL kafka: couldn't get offsets of %s#%d from %s: %s\n", topic, partition, hostname, err)
+    return false
+  }
+  contents := new(bytes.Buffer)
+  consumed := 0
+  _, err = kafka.NewBrokerConsumer(hostname, topic, int(partition), earliest, maxMessageSize).Consume(func(msg *kafka.Message) {
+    if consumed >= SELF_TEST_MESSAGES { return }
+    for _, piece := range recordFraming.Frame(EncodeRecord(TopicOutputFormat(topic), &topic, partition, msg.Offset(), msg.Payload())) {
+      contents.Write(piece)
+    }
+    consumed++
+  })
+  if err != nil {
+    fmt.Printf("FAIL kafka: couldn't consume %s#%d from %s: %s\n", topic, partition, hostname, err)
+    return false
+  }
+  if consumed == 0 {
+    fmt.Printf("PASS kafka: reached %s, but %s#%d is empty, testing S3 with a placeholder\n", hostname, topic, partition)
+    contents.WriteString(fmt.Sprintf("kafka-s3-consumer selftest %d\n", time.Now().UnixNano()))
+  } else {
+    fmt.Printf("PASS kafka: consumed %d messages from %s#%d at Offset:%d\n", consumed, topic, partition, earliest)
+  }
+
+  s3path := fmt.Sprintf("%s%d", S3_SELF_TEST_PREFIX, time.Now().UnixNano())
+  if err = PutWithRetry(destination, s3path, contents.Bytes(), "application/octet-stream", nil); err != nil {
+    fmt.Printf("FAIL s3 put: %s to %s: %s\n", s3path, destination.Name(), err)
+    return false
+  }
+  fmt.Printf("PASS s3 put: %s\n", s3path)
+  passed := selfTestReadBack(destination, s3path, contents.Bytes())
+  if err = destination.Delete(s3path); err != nil {
+    fmt.Printf("FAIL s3 delete: %s: %s\n", s3path, err)
+    return false
+  }
+  fmt.Printf("PASS s3 delete: %s\n", s3path)
+  return passed
+}
+
+func selfTestReadBack(destination Destination, s3path string, expected []byte) bool {
+  results, err := ListS3(destination, s3path, "")
+  if err != nil {
+    fmt.Printf("FAIL s3 list: %s: %s\n", S3_SELF_TEST_PREFIX, err)
+    return false
+  }
+  if len(results.Contents) == 0 || results.Contents[0].Key != s3path {
+    fmt.Printf("FAIL s3 list: %s wasn't listed\n", s3path)
+    return false
+  }
+  fmt.Printf("PASS s3 list: %s\n", s3path)
+
+  contents, err := destination.Get(s3path)
+  if err != nil {
+    fmt.Printf("FAIL s3 get: %s: %s\n", s3path, err)
+    return false
+  }
+  if !bytes.Equal(contents, expected) {
+    fmt.Printf("FAIL s3 get: %s read back %d bytes that don't match the %d written\n", s3path, len(contents), len(expected))
+    return false
+  }
+  fmt.Printf("PASS s3 get: %s matches what was written\n", s3path)
+  return true
+}
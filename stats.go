@@ -0,0 +1,41 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "sync/atomic"
+  "time"
+)
+
+// PartitionStats counts what a partition has consumed, updated from its consume callback.
+type PartitionStats struct {
+  Messages int64
+  Bytes    int64
+}
+
+func (stats *PartitionStats) Consumed(payloadBytes int) {
+  atomic.AddInt64(&stats.Messages, 1)
+  atomic.AddInt64(&stats.Bytes, int64(payloadBytes))
+}
+
+// ReportStatsEvery logs each partition's message and byte rate over the last interval,
+// from the difference between samples of its counters.
+func ReportStatsEvery(interval time.Duration, names []string, stats []*PartitionStats) {
+  go func() {
+    lastMessages := make([]int64, len(stats))
+    lastBytes := make([]int64, len(stats))
+    lastSampledAt := time.Now()
+    for sampledAt := range time.Tick(interval) {
+      seconds := sampledAt.Sub(lastSampledAt).Seconds()
+      for i, partitionStats := range stats {
+        messages := atomic.LoadInt64(&partitionStats.Messages)
+        bytes := atomic.LoadInt64(&partitionStats.Bytes)
+        Log.Infof("Stats %s: %.1f msg/s, %.1f bytes/s", names[i], float64(messages - lastMessages[i]) / seconds, float64(bytes - lastBytes[i]) / seconds)
+        lastMessages[i], lastBytes[i] = messages, bytes
+      }
+      lastSampledAt = sampledAt
+    }
+  }()
+}
@@ -0,0 +1,152 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+type S3ObjectRange struct {
+  Key         string
+  FirstOffset uint64
+  LastOffset  uint64
+}
+
+type s3ObjectRanges []S3ObjectRange
+
+func (ranges s3ObjectRanges) Len() int           { return len(ranges) }
+func (ranges s3ObjectRanges) Less(i, j int) bool { return ranges[i].FirstOffset < ranges[j].FirstOffset }
+func (ranges s3ObjectRanges) Swap(i, j int)      { ranges[i], ranges[j] = ranges[j], ranges[i] }
+
+// S3ObjectOffsetRange reads the first and last offsets of an object, from its sidecar when
+// there is one, otherwise by scanning the whole object.
+func S3ObjectOffsetRange(destination Destination, key string, topic *string, partition int64) (first uint64, last uint64, found bool, err error) {
+  if indexBytes, err := destination.Get(key + S3_INDEX_SUFFIX); err == nil {
+    var index BlockIndex
+    if json.Unmarshal(indexBytes, &index) == nil && index.Records > 0 {
+      return index.FirstKafkaOffset, index.LastKafkaOffset, true, nil
+    }
+  }
+
+  layout, err := ObjectRecordLayout(destination, key)
+  if err != nil {
+    return 0, 0, false, err
+  }
+  parseOffset := RecordOffsetParser(TopicOutputFormat(*topic), layout.Header, topic, partition)
+  if parseOffset == nil {
+    return 0, 0, false, nil
+  }
+  contentBytes, err := destination.Get(key)
+  if err != nil {
+    return 0, 0, false, err
+  }
+  contentBytes, err = DecompressS3Object(key, contentBytes)
+  if err != nil {
+    return 0, 0, false, err
+  }
+  records, _ := SplitRecords(layout.Framing, contentBytes)
+  for _, record := range records {
+    if offset, ok := parseOffset(string(record)); ok {
+      if !found {
+        first, found = offset, true
+      }
+      last = offset
+    }
+  }
+  return first, last, found, nil
+}
+
+// VerifyContinuity reads the offset range of every object archived for a topic/partition and
+// reports objects whose ranges overlap, returning how many problems it found.  Kafka 0.7
+// offsets are byte positions, so the size of a gap between two objects can't be told from
+// their offsets alone, only that they're in order.
+func VerifyContinuity(destination Destination, topic *string, partition int64) (int, error) {
+  prefix := S3TopicPartitionPrefix(topic, partition)
+  ranges := make(s3ObjectRanges, 0)
+  problems := 0
+  keyMarker := ""
+  for moreResults := true; moreResults; {
+    results, err := ListS3(destination, prefix, keyMarker)
+    if err != nil {
+      return problems, err
+    }
+    if len(results.Contents) == 0 {
+      break
+    }
+    for _, key := range results.Contents {
+      if IsSidecarKey(key.Key) { continue }
+      first, last, found, err := S3ObjectOffsetRange(destination, key.Key, topic, partition)
+      if err != nil {
+        fmt.Printf("UNREADABLE %s: %s\n", key.Key, err)
+        problems++
+        continue
+      }
+      if !found {
+        fmt.Printf("NO OFFSETS %s\n", key.Key)
+        problems++
+        continue
+      }
+      ranges = append(ranges, S3ObjectRange{Key: key.Key, FirstOffset: first, LastOffset: last})
+    }
+    keyMarker = results.Contents[len(results.Contents)-1].Key
+    moreResults = results.IsTruncated
+  }
+
+  sort.Sort(ranges)
+  for r, objectRange := range ranges {
+    if r > 0 && objectRange.FirstOffset <= ranges[r-1].LastOffset {
+      fmt.Printf("OVERLAP %s (Offset:%d-%d) with %s (Offset:%d-%d)\n", objectRange.Key, objectRange.FirstOffset, objectRange.LastOffset, ranges[r-1].Key, ranges[r-1].FirstOffset, ranges[r-1].LastOffset)
+      problems++
+    } else if debug {
+      fmt.Printf("OK %s (Offset:%d-%d)\n", objectRange.Key, objectRange.FirstOffset, objectRange.LastOffset)
+    }
+  }
+  fmt.Printf("Verified %d objects under %s, %d problems\n", len(ranges), prefix, problems)
+  return problems, nil
+}
+
+// ParseTopicPartition splits a `topic#partition` argument.
+func ParseTopicPartition(topicPartition string) (string, int64, error) {
+  separator := strings.LastIndex(topicPartition, "#")
+  if separator < 0 {
+    return "", 0, fmt.Errorf("expected topic#partition, got `%s`", topicPartition)
+  }
+  partition, err := strconv.ParseInt(topicPartition[separator+1:], 10, 64)
+  if err != nil {
+    return "", 0, fmt.Errorf("expected topic#partition, got `%s`", topicPartition)
+  }
+  return topicPartition[:separator], partition, nil
+}
+
+// ExpandTopicPartitions turns `topic:<partition>` and `topic:<first>-<last>` entries into a
+// topic and partition for every partition they name.
+func ExpandTopicPartitions(entries []string) ([]string, []int64, error) {
+  topics := make([]string, 0, len(entries))
+  partitions := make([]int64, 0, len(entries))
+  for _, entry := range entries {
+    separator := strings.LastIndex(entry, ":")
+    if separator < 0 {
+      return nil, nil, fmt.Errorf("expected topic:partition or topic:first-last without a partitions list, got `%s`", entry)
+    }
+    partitionRange := strings.SplitN(entry[separator+1:], "-", 2)
+    first, err := strconv.ParseInt(partitionRange[0], 10, 64)
+    last := first
+    if err == nil && len(partitionRange) == 2 {
+      last, err = strconv.ParseInt(partitionRange[1], 10, 64)
+    }
+    if err != nil || last < first {
+      return nil, nil, fmt.Errorf("expected topic:partition or topic:first-last, got `%s`", entry)
+    }
+    for partition := first; partition <= last; partition++ {
+      topics = append(topics, entry[:separator])
+      partitions = append(partitions, partition)
+    }
+  }
+  return topics, partitions, nil
+}
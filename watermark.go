@@ -0,0 +1,64 @@
+/*
+Author: Matthew Moore, CrowdMob Inc.
+*/
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "sync"
+  "time"
+)
+
+// Set in main when `watermarkfile` is configured, nil otherwise.
+var watermarks *WatermarkFile
+
+type PartitionWatermark struct {
+  Topic       string    `json:"topic"`
+  Partition   int64     `json:"partition"`
+  LastOffset  uint64    `json:"last_offset"`
+  LastFlushAt time.Time `json:"last_flush_at"`
+  ObjectCount int64     `json:"object_count"`
+}
+
+// WatermarkFile keeps a local JSON file up to date with how far each partition has been
+// flushed, for monitoring that can't reach S3 or an HTTP port.
+type WatermarkFile struct {
+  Path       string
+  lock       sync.Mutex
+  partitions map[string]*PartitionWatermark
+}
+
+func NewWatermarkFile(path string) *WatermarkFile {
+  return &WatermarkFile{Path: path, partitions: make(map[string]*PartitionWatermark)}
+}
+
+// Flushed records an object written for a topic/partition and rewrites the file, to a temp
+// file renamed into place so readers never see half of it.
+func (watermarkFile *WatermarkFile) Flushed(topic string, partition int64, lastOffset uint64) error {
+  watermarkFile.lock.Lock()
+  defer watermarkFile.lock.Unlock()
+
+  name := fmt.Sprintf("%s#%d", topic, partition)
+  watermark, ok := watermarkFile.partitions[name]
+  if !ok {
+    watermark = &PartitionWatermark{Topic: topic, Partition: partition}
+    watermarkFile.partitions[name] = watermark
+  }
+  watermark.LastOffset = lastOffset
+  watermark.LastFlushAt = time.Now()
+  watermark.ObjectCount++
+
+  watermarkBytes, err := json.MarshalIndent(watermarkFile.partitions, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmpPath := watermarkFile.Path + ".tmp"
+  if err = ioutil.WriteFile(tmpPath, watermarkBytes, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, watermarkFile.Path)
+}